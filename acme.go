@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// newACMEManager returns an autocert manager that obtains and renews
+// certificates for the configured domains, caching them on disk.
+func newACMEManager(config *Config) (*autocert.Manager, error) {
+	if len(config.ACMEDomains) == 0 {
+		return nil, fmt.Errorf("at least one ACME domain is required")
+	}
+	if err := checkWritableDir(config.ACMECacheDir); err != nil {
+		return nil, fmt.Errorf("ACME cache directory %s is not writable: %v", config.ACMECacheDir, err)
+	}
+
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(config.ACMEDomains...),
+		Cache:      autocert.DirCache(config.ACMECacheDir),
+		Email:      config.ACMEEmail,
+	}, nil
+}
+
+// checkWritableDir creates dir if needed and confirms a file can be written
+// to it.
+func checkWritableDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".write-check-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// validateACMEDomains rejects entries that are not bare host names.
+func validateACMEDomains(domains []string) error {
+	for _, domain := range domains {
+		if strings.ContainsAny(domain, ":/ ") {
+			return fmt.Errorf("invalid ACME domain %q, expected a bare host name", domain)
+		}
+	}
+	return nil
+}
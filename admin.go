@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// adminAPI lets operators take backends out of rotation for maintenance.
+// POST <prefix>/backends/{id}/drain stops sending new requests to every
+// backend with that ID, and .../undrain puts them back. Requests
+// already sent to a draining backend finish normally. POST
+// <prefix>/maintenance/on and .../off switch maintenance mode.
+type adminAPI struct {
+	token       string
+	live        *atomic.Pointer[liveSettings]
+	domains     *domainRouter
+	metrics     *relayMetrics
+	maintenance *maintenanceMode
+}
+
+// register adds the admin endpoints under prefix to mux.
+func (a *adminAPI) register(mux *http.ServeMux, prefix string) {
+	mux.Handle(prefix+"/backends/{id}/{action}", a)
+	mux.HandleFunc(prefix+"/maintenance/{action}", a.setMaintenance)
+}
+
+// authorized checks the bearer token, answering 401 if it is wrong.
+func (a *adminAPI) authorized(w http.ResponseWriter, r *http.Request) bool {
+	if !validBearerToken(r, a.token) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="jnb-relay"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// postOnly answers 405 to anything but a POST, since every admin action
+// changes state.
+func postOnly(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+func (a *adminAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(w, r) {
+		return
+	}
+
+	var draining bool
+	switch r.PathValue("action") {
+	case "drain":
+		draining = true
+	case "undrain":
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if !postOnly(w, r) {
+		return
+	}
+
+	id := r.PathValue("id")
+	var found *backend
+	pools := append(a.live.Load().pools(), a.domains.pools()...)
+	for _, pool := range pools {
+		for _, b := range pool.backends {
+			if b.id() != id {
+				continue
+			}
+			found = b
+			b.draining.Store(draining)
+		}
+	}
+	if found == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown backend " + id})
+		return
+	}
+
+	if draining {
+		infof("Backend %s is draining; new requests go to other backends", found)
+	} else {
+		infof("Backend %s is no longer draining", found)
+	}
+	if a.metrics != nil {
+		a.metrics.setBackendDraining(id, draining)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"backend": id, "address": found.String(), "draining": draining})
+}
+
+// setMaintenance switches maintenance mode on or off.
+func (a *adminAPI) setMaintenance(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(w, r) {
+		return
+	}
+
+	var on bool
+	switch r.PathValue("action") {
+	case "on":
+		on = true
+	case "off":
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if !postOnly(w, r) {
+		return
+	}
+
+	a.maintenance.set(on)
+	writeJSON(w, http.StatusOK, map[string]bool{"maintenance": on})
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// socketBackendHost is the URL host of a Unix socket backend, for which the
+// transport dials the socket. The reserved .invalid name keeps it from
+// clashing with TCP backends, such as one on localhost:80.
+const socketBackendHost = "unix-socket.invalid"
+
+// socketHostHeader is the Host header Unix socket backends see.
+const socketHostHeader = "localhost"
+
+// backend is a single upstream the relay can forward requests to.
+type backend struct {
+	url    *url.URL
+	socket string
+	weight int
+
+	// current is the smooth weighted round-robin score, guarded by the
+	// pool's mu
+	current int
+
+	// down is set by health checks while the backend is out of rotation
+	down atomic.Bool
+
+	// draining is set through the admin API to send new requests elsewhere
+	draining atomic.Bool
+}
+
+// available reports whether the backend should get new requests.
+func (b *backend) available() bool {
+	return !b.down.Load() && !b.draining.Load()
+}
+
+// id identifies the backend in the admin API, the status page, metrics and
+// sticky session cookies. It is the address of TCP backends and the
+// reserved socketBackendHost for the Unix socket backend, so it never holds
+// a slash and fits in a URL path segment.
+func (b *backend) id() string {
+	return b.url.Host
+}
+
+// hostHeader returns the Host header requests to the backend carry.
+func (b *backend) hostHeader() string {
+	if b.socket != "" {
+		return socketHostHeader
+	}
+	return b.url.Host
+}
+
+// address returns the network and address to dial to reach the backend.
+func (b *backend) address() (network, addr string) {
+	if b.socket != "" {
+		return "unix", b.socket
+	}
+	return "tcp", b.url.Host
+}
+
+// backendPool hands out backends in round-robin order, weighted when the
+// backends' weights differ. It is safe for concurrent use.
+type backendPool struct {
+	backends []*backend
+	next     atomic.Uint64
+
+	weighted bool
+	mu       sync.Mutex
+}
+
+// newBackendPool builds a pool from a comma-separated list of hosts. Entries
+// may carry their own port, e.g. "10.0.0.1:8443"; entries without one use
+// defaultPort. Backends are reached over scheme, "http" or "https". An entry
+// may end in "=weight", e.g. "10.0.0.1:8443=3", to get that many times the
+// share of a backend with the default weight of 1.
+func newBackendPool(hosts string, defaultPort int, scheme string) (*backendPool, error) {
+	pool := &backendPool{}
+	for _, entry := range splitList(hosts) {
+		addr, weight, err := splitBackendWeight(entry)
+		if err != nil {
+			return nil, err
+		}
+		host, port, err := splitBackendAddr(addr, defaultPort)
+		if err != nil {
+			return nil, err
+		}
+		target, err := url.Parse(scheme + "://" + net.JoinHostPort(host, strconv.Itoa(port)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid backend %q: %v", entry, err)
+		}
+		pool.backends = append(pool.backends, &backend{url: target, weight: weight})
+		pool.weighted = pool.weighted || weight != pool.backends[0].weight
+	}
+	if len(pool.backends) == 0 {
+		return nil, fmt.Errorf("no backends configured")
+	}
+	return pool, nil
+}
+
+// newUpstreamPool builds the default pool from either --proxy-for-socket or
+// --proxy-for-host and --proxy-for-port.
+func newUpstreamPool(config *Config) (*backendPool, error) {
+	if config.ProxySocket != "" {
+		return newSocketPool(config.ProxySocket), nil
+	}
+	return newBackendPool(config.ProxyHost, config.ProxyPort, backendScheme(config))
+}
+
+// backendScheme returns the scheme the backends are reached over.
+func backendScheme(config *Config) string {
+	if config.BackendTLS {
+		return "https"
+	}
+	return "http"
+}
+
+// newSocketPool builds a pool with a single backend listening on the Unix
+// socket at path.
+func newSocketPool(path string) *backendPool {
+	target := &url.URL{Scheme: "http", Host: socketBackendHost}
+	return &backendPool{backends: []*backend{{url: target, socket: path, weight: 1}}}
+}
+
+// pick returns the next backend in rotation, skipping backends that health
+// checks marked down or that are draining. If no backend is available it
+// picks one anyway, so the client gets the backend's error rather than none
+// at all.
+func (p *backendPool) pick() *backend {
+	if len(p.backends) == 1 {
+		return p.backends[0]
+	}
+	if p.weighted {
+		return p.pickWeighted()
+	}
+	n := p.next.Add(1) - 1
+	count := uint64(len(p.backends))
+	for i := uint64(0); i < count; i++ {
+		if b := p.backends[(n+i)%count]; b.available() {
+			return b
+		}
+	}
+	return p.backends[n%count]
+}
+
+// pickWeighted implements nginx's smooth weighted round-robin: every pick
+// raises each backend's score by its weight, and the highest scorer is
+// picked and lowered by the total weight. Picks are spread out rather than
+// sent to one backend in a run.
+func (p *backendPool) pickWeighted() *backend {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if b := p.pickWeightedLocked(true); b != nil {
+		return b
+	}
+	return p.pickWeightedLocked(false)
+}
+
+func (p *backendPool) pickWeightedLocked(availableOnly bool) *backend {
+	var best *backend
+	total := 0
+	for _, b := range p.backends {
+		if availableOnly && !b.available() {
+			continue
+		}
+		b.current += b.weight
+		total += b.weight
+		if best == nil || b.current > best.current {
+			best = b
+		}
+	}
+	if best != nil {
+		best.current -= total
+	}
+	return best
+}
+
+// String returns the backend address for log output.
+func (b *backend) String() string {
+	if b.socket != "" {
+		return "unix:" + b.socket
+	}
+	return b.url.Host
+}
+
+// sameBackends reports whether other lists the same backends, in the same
+// order and with the same weights.
+func (p *backendPool) sameBackends(other *backendPool) bool {
+	if len(p.backends) != len(other.backends) {
+		return false
+	}
+	for i, b := range p.backends {
+		o := other.backends[i]
+		if b.url.String() != o.url.String() || b.socket != o.socket || b.weight != o.weight {
+			return false
+		}
+	}
+	return true
+}
+
+// String lists the backend addresses for log output.
+func (p *backendPool) String() string {
+	hosts := make([]string, len(p.backends))
+	for i, b := range p.backends {
+		hosts[i] = b.String()
+	}
+	return strings.Join(hosts, ",")
+}
+
+// splitBackendWeight separates an optional "=weight" suffix from a backend
+// entry, returning a weight of 1 when there is none.
+func splitBackendWeight(entry string) (string, int, error) {
+	addr, weightStr, ok := strings.Cut(entry, "=")
+	if !ok {
+		return entry, 1, nil
+	}
+	weight, err := strconv.Atoi(weightStr)
+	if err != nil || weight <= 0 {
+		return "", 0, fmt.Errorf("backend %q has an invalid weight, expected a positive integer", entry)
+	}
+	return addr, weight, nil
+}
+
+// splitBackendAddr separates an optional port from a backend host entry,
+// falling back to defaultPort when the entry has none.
+func splitBackendAddr(entry string, defaultPort int) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(entry)
+	if err != nil {
+		// No port given; allow bare and bracketed IPv6 addresses
+		host = strings.TrimSuffix(strings.TrimPrefix(entry, "["), "]")
+		if defaultPort == 0 {
+			return "", 0, fmt.Errorf("backend %q has no port and --proxy-for-port is not set", entry)
+		}
+		return host, defaultPort, nil
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return "", 0, fmt.Errorf("backend %q has an invalid port", entry)
+	}
+	return host, port, nil
+}
+
+// backendsHavePorts reports whether every entry in a comma-separated host list
+// specifies its own port, making --proxy-for-port unnecessary.
+func backendsHavePorts(hosts string) bool {
+	entries := splitList(hosts)
+	for _, entry := range entries {
+		addr, _, _ := strings.Cut(entry, "=")
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return false
+		}
+	}
+	return len(entries) > 0
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+)
+
+// basicAuthContext marks requests whose Authorization header carries the
+// relay's own basic auth credentials, rather than ones meant for the backend.
+type basicAuthContext struct{}
+
+// basicAuth requires HTTP Basic credentials matching user and pass before
+// passing requests to next.
+func basicAuth(user, pass string, next http.Handler) http.Handler {
+	wantUser := sha256.Sum256([]byte(user))
+	wantPass := sha256.Sum256([]byte(pass))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotUser, gotPass, ok := r.BasicAuth()
+
+		// Compare fixed-size digests in constant time, checking both fields
+		// so a wrong user and a wrong password take the same time
+		userHash := sha256.Sum256([]byte(gotUser))
+		passHash := sha256.Sum256([]byte(gotPass))
+		userMatch := subtle.ConstantTimeCompare(userHash[:], wantUser[:])
+		passMatch := subtle.ConstantTimeCompare(passHash[:], wantPass[:])
+
+		if !ok || userMatch&passMatch != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="jnb-relay", charset="UTF-8"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), basicAuthContext{}, true)))
+	})
+}
+
+// relayCredentials reports whether r was let through by basicAuth, so its
+// Authorization header holds the credentials every user of the relay shares.
+func relayCredentials(r *http.Request) bool {
+	ok, _ := r.Context().Value(basicAuthContext{}).(bool)
+	return ok
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"net/http"
+)
+
+// limitRequestBody rejects requests whose body is larger than limit bytes.
+// A declared Content-Length over the limit is refused before anything is
+// forwarded; bodies without one are cut off once they pass the limit, which
+// the proxy's error handler turns into a 413 as well.
+func limitRequestBody(limit int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > limit {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next.ServeHTTP(w, r)
+	})
+}
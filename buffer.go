@@ -0,0 +1,23 @@
+package main
+
+import "sync"
+
+// bufferPool hands the reverse proxy fixed-size buffers for copying
+// response bodies to the client. It implements httputil.BufferPool.
+type bufferPool struct {
+	pool sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	return &bufferPool{pool: sync.Pool{
+		New: func() any { return make([]byte, size) },
+	}}
+}
+
+func (p *bufferPool) Get() []byte {
+	return p.pool.Get().([]byte)
+}
+
+func (p *bufferPool) Put(b []byte) {
+	p.pool.Put(b)
+}
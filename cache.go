@@ -0,0 +1,290 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// extensionSet is a set of lower-case file extensions including the dot.
+type extensionSet map[string]bool
+
+func newExtensionSet(extensions []string) extensionSet {
+	set := extensionSet{}
+	for _, ext := range extensions {
+		set[strings.ToLower(ext)] = true
+	}
+	return set
+}
+
+// matches reports whether the last element of path has one of the
+// extensions.
+func (s extensionSet) matches(path string) bool {
+	return s[strings.ToLower(filepath.Ext(path))]
+}
+
+// cacheKeyContext carries the cache key of a request from the cache handler
+// to ModifyResponse.
+type cacheKeyContext struct{}
+
+// cacheEntry is a stored response.
+type cacheEntry struct {
+	key     string
+	status  int
+	header  http.Header
+	body    []byte
+	stored  time.Time
+	expires time.Time
+}
+
+// responseCache is an in-memory LRU cache of static asset responses, bounded
+// by the total size of the stored bodies.
+type responseCache struct {
+	ttl        time.Duration
+	maxBytes   int64
+	maxEntry   int64
+	extensions extensionSet
+
+	mu       sync.Mutex
+	lru      *list.List
+	entries  map[string]*list.Element
+	size     int64
+	inflight map[string]chan struct{}
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+// newResponseCache returns a cache holding up to maxBytes of bodies, each of
+// them at most maxEntry bytes.
+func newResponseCache(ttl time.Duration, maxBytes, maxEntry int64, extensions extensionSet) *responseCache {
+	return &responseCache{
+		ttl:        ttl,
+		maxBytes:   maxBytes,
+		maxEntry:   min(maxEntry, maxBytes),
+		extensions: extensions,
+		lru:        list.New(),
+		entries:    map[string]*list.Element{},
+		inflight:   map[string]chan struct{}{},
+	}
+}
+
+// middleware serves cached responses before the request reaches next. On a
+// miss only one request per key is forwarded; concurrent requests for the
+// same key wait for it and are then served from the cache.
+func (c *responseCache) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, ok := c.key(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if c.serve(w, key) {
+			c.hits.Add(1)
+			return
+		}
+
+		wait, leader := c.begin(key)
+		if !leader {
+			select {
+			case <-wait:
+			case <-r.Context().Done():
+				// The client gave up before the leader's response arrived
+				return
+			}
+			if c.serve(w, key) {
+				c.hits.Add(1)
+				return
+			}
+			// The response turned out not to be cacheable
+			c.misses.Add(1)
+			next.ServeHTTP(w, r)
+			return
+		}
+		defer c.end(key)
+		c.misses.Add(1)
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), cacheKeyContext{}, key)))
+	})
+}
+
+// key returns the key for cacheable requests: GETs for static assets
+// without credentials other than the relay's own basic auth. The key
+// includes whether the client accepts gzip so compressed and uncompressed
+// variants are stored separately.
+func (c *responseCache) key(r *http.Request) (string, bool) {
+	if r.Method != http.MethodGet || (r.Header.Get("Authorization") != "" && !relayCredentials(r)) {
+		return "", false
+	}
+	if !c.extensions.matches(r.URL.Path) {
+		return "", false
+	}
+
+	key := r.Host + r.URL.RequestURI()
+	if acceptsGzip(r.Header) {
+		key += " gzip"
+	}
+	return key, true
+}
+
+// serve writes the cached response for key if there is a fresh one.
+func (c *responseCache) serve(w http.ResponseWriter, key string) bool {
+	entry := c.get(key)
+	if entry == nil {
+		return false
+	}
+
+	for name, values := range entry.header {
+		w.Header()[name] = values
+	}
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(entry.stored).Seconds())))
+	w.Header().Set("Content-Length", strconv.Itoa(len(entry.body)))
+	w.WriteHeader(entry.status)
+	w.Write(entry.body)
+	return true
+}
+
+// begin registers a fetch for key. It returns leader true for the first
+// caller; others get a channel that is closed when that fetch ends.
+func (c *responseCache) begin(key string) (wait chan struct{}, leader bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if wait, ok := c.inflight[key]; ok {
+		return wait, false
+	}
+	c.inflight[key] = make(chan struct{})
+	return nil, true
+}
+
+func (c *responseCache) end(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	close(c.inflight[key])
+	delete(c.inflight, key)
+}
+
+// capture arranges for a cacheable backend response to be stored once its
+// body has been read in full. It is called from ModifyResponse.
+func (c *responseCache) capture(resp *http.Response) {
+	key, ok := resp.Request.Context().Value(cacheKeyContext{}).(string)
+	if !ok || !cacheableResponse(resp) {
+		return
+	}
+
+	header := resp.Header.Clone()
+	header.Del("Date")
+	resp.Body = &cachingBody{
+		ReadCloser: resp.Body,
+		cache:      c,
+		entry:      &cacheEntry{key: key, status: resp.StatusCode, header: header},
+	}
+}
+
+// cacheableResponse skips anything the backend marked as uncacheable or
+// specific to one client.
+func cacheableResponse(resp *http.Response) bool {
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Set-Cookie") != "" {
+		return false
+	}
+	if vary := resp.Header.Get("Vary"); vary != "" && !strings.EqualFold(vary, "Accept-Encoding") {
+		return false
+	}
+	cacheControl := strings.ToLower(resp.Header.Get("Cache-Control"))
+	for _, directive := range []string{"no-store", "no-cache", "private"} {
+		if strings.Contains(cacheControl, directive) {
+			return false
+		}
+	}
+	return true
+}
+
+// cachingBody copies the body into a cache entry as the proxy streams it to
+// the client, storing the entry at EOF. Bodies larger than the cache's
+// maxEntry are dropped rather than buffered.
+type cachingBody struct {
+	io.ReadCloser
+	cache    *responseCache
+	entry    *cacheEntry
+	tooLarge bool
+}
+
+func (b *cachingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if !b.tooLarge {
+		b.entry.body = append(b.entry.body, p[:n]...)
+		if int64(len(b.entry.body)) > b.cache.maxEntry {
+			warnf("Not caching %s: body exceeds --max-buffered-body or --cache-max-size", b.entry.key)
+			b.tooLarge = true
+			b.entry.body = nil
+		}
+	}
+	if err == io.EOF && !b.tooLarge {
+		b.cache.put(b.entry)
+		b.tooLarge = true
+	}
+	return n, err
+}
+
+func (c *responseCache) get(key string) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := elem.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(elem)
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	return entry
+}
+
+func (c *responseCache) put(entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry.stored = time.Now()
+	entry.expires = entry.stored.Add(c.ttl)
+	if elem, ok := c.entries[entry.key]; ok {
+		c.remove(elem)
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.size += int64(len(entry.body))
+
+	// Evict the least recently used entries until the cache fits
+	for c.size > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+// status summarizes the cache for the status page.
+func (c *responseCache) status() *cacheStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return &cacheStatus{
+		Entries:  len(c.entries),
+		Bytes:    c.size,
+		MaxBytes: c.maxBytes,
+		Hits:     c.hits.Load(),
+		Misses:   c.misses.Load(),
+	}
+}
+
+func (c *responseCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= int64(len(entry.body))
+}
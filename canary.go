@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// canaryBuckets is how finely clients are split: the canary takes the
+// buckets below percent/100 of it, so percentages down to 0.01 work.
+const canaryBuckets = 10000
+
+// canaryContext is the request context key for a client's pinned bucket.
+type canaryContext struct{}
+
+// toCanary reports whether a request for the default backends goes to the
+// canary backends instead, which happens for percent of requests. A client
+// pinned by canaryPinning keeps its bucket, so it stays on one version, and
+// raising percent only ever moves clients from stable to canary.
+func toCanary(req *http.Request, percent float64) bool {
+	bucket, ok := req.Context().Value(canaryContext{}).(int)
+	if !ok {
+		bucket = rand.IntN(canaryBuckets)
+	}
+	return float64(bucket) < percent*canaryBuckets/100
+}
+
+// canaryPinning assigns each client a random bucket, kept in a cookie, that
+// decides whether its requests go to the canary.
+type canaryPinning struct {
+	cookie string
+	path   string
+	live   *atomic.Pointer[liveSettings]
+}
+
+func newCanaryPinning(cookie string, mount mountPath, live *atomic.Pointer[liveSettings]) *canaryPinning {
+	path := "/"
+	if mount != "" {
+		path = string(mount)
+	}
+	return &canaryPinning{cookie: cookie, path: path, live: live}
+}
+
+// middleware passes the client's bucket on to the director, setting the
+// cookie for clients that don't have a valid one yet. Nothing is pinned
+// while no canary is configured.
+func (p *canaryPinning) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p.live.Load().canary == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		bucket := -1
+		if c, err := r.Cookie(p.cookie); err == nil {
+			if n, err := strconv.Atoi(c.Value); err == nil && n >= 0 && n < canaryBuckets {
+				bucket = n
+			}
+		}
+		if bucket < 0 {
+			bucket = rand.IntN(canaryBuckets)
+			http.SetCookie(w, &http.Cookie{
+				Name:     p.cookie,
+				Value:    strconv.Itoa(bucket),
+				Path:     p.path,
+				HttpOnly: true,
+				Secure:   publicOriginOf(r).scheme == "https",
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), canaryContext{}, bucket)))
+	})
+}
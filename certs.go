@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader serves a certificate loaded from disk and reloads it when the
+// certificate or key file changes. A failed reload keeps the previous
+// certificate in service.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	strict   bool
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+}
+
+func newCertReloader(certFile, keyFile string, strict bool) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile, strict: strict}
+	if _, err := r.changed(); err != nil {
+		return nil, err
+	}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// watch checks the files for changes every interval and reloads them.
+func (r *certReloader) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		changed, err := r.changed()
+		if err != nil {
+			errorf("Certificate reload check failed: %v", err)
+			continue
+		}
+		if !changed {
+			continue
+		}
+		if err := r.reload(); err != nil {
+			errorf("Certificate reload failed, keeping previous certificate: %v", err)
+			continue
+		}
+		infof("Reloaded certificate from %s", r.certFile)
+	}
+}
+
+// changed reports whether either file was modified since the last check.
+// A reload that fails is therefore retried once the files are written again,
+// rather than on every check.
+func (r *certReloader) changed() (bool, error) {
+	certMod, keyMod, err := r.modTimes()
+	if err != nil {
+		return false, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	changed := !certMod.Equal(r.certMod) || !keyMod.Equal(r.keyMod)
+	r.certMod = certMod
+	r.keyMod = keyMod
+	return changed, nil
+}
+
+// reload loads the key pair and swaps it in.
+func (r *certReloader) reload() error {
+	cert, err := loadKeyPair(r.certFile, r.keyFile, r.strict)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = cert
+	return nil
+}
+
+// loadKeyPair loads a certificate and its private key, failing if they don't
+// match. A certificate outside its validity period is logged as a warning,
+// or rejected if strict is set.
+func loadKeyPair(certFile, keyFile string, strict bool) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load certificate %s and key %s: %v", certFile, keyFile, err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse certificate %s: %v", certFile, err)
+	}
+	cert.Leaf = leaf
+
+	if err := checkValidity(leaf, time.Now()); err != nil {
+		err = fmt.Errorf("certificate %s %v", certFile, err)
+		if strict {
+			return nil, err
+		}
+		warnf("%v", err)
+	}
+	return &cert, nil
+}
+
+// checkValidity reports whether now falls outside the certificate's validity
+// period.
+func checkValidity(cert *x509.Certificate, now time.Time) error {
+	if now.Before(cert.NotBefore) {
+		return fmt.Errorf("is not valid until %s", cert.NotBefore.Format(time.RFC3339))
+	}
+	if now.After(cert.NotAfter) {
+		return fmt.Errorf("expired on %s", cert.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func (r *certReloader) modTimes() (time.Time, time.Time, error) {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
@@ -0,0 +1,47 @@
+package main
+
+// checkConfig goes beyond the flag validation in parseFlags and verifies
+// what the relay would otherwise only discover while starting up: that the
+// backend addresses parse, that the error page template parses, and that the
+// certificate files, including those of each domain, hold a valid key pair.
+// It does not bind any ports.
+func checkConfig(config *Config) error {
+	pool, err := newUpstreamPool(config)
+	if err != nil {
+		return err
+	}
+	if _, err := newRouter(config.Routes, pool, config.ProxyPort, backendScheme(config), config.StripPrefix); err != nil {
+		return err
+	}
+	if _, err := newDomainRouter(config.Domains, config.ProxyPort, backendScheme(config), config.StripPrefix, config.StrictCertValidity); err != nil {
+		return err
+	}
+
+	if err := registerMimeTypes(config.MimeTypes); err != nil {
+		return err
+	}
+
+	if _, err := newErrorPage(config.ErrorPage); err != nil {
+		return err
+	}
+	if _, err := newMaintenanceMode(config.MaintenancePage, config.MaintenanceRetryAfter); err != nil {
+		return err
+	}
+
+	if config.CertFile != "" {
+		if _, err := loadKeyPair(config.CertFile, config.KeyFile, config.StrictCertValidity); err != nil {
+			return err
+		}
+	}
+	if config.BackendCAFile != "" {
+		if _, err := loadCertPool(config.BackendCAFile); err != nil {
+			return err
+		}
+	}
+	if config.ClientCAFile != "" {
+		if _, err := loadCertPool(config.ClientCAFile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
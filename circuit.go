@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// errCircuitOpen is returned for requests refused by an open circuit.
+var errCircuitOpen = errors.New("circuit breaker open")
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// circuit tracks the health of a single backend.
+type circuit struct {
+	state    circuitState
+	failures int
+	openedAt time.Time
+	trial    bool
+}
+
+// circuitBreaker stops sending requests to a backend after threshold
+// consecutive failures. Once resetTimeout has passed a single trial request
+// is let through; its outcome closes the circuit or opens it again.
+type circuitBreaker struct {
+	threshold    int
+	resetTimeout time.Duration
+
+	mu       sync.Mutex
+	circuits map[string]*circuit
+}
+
+func newCircuitBreaker(threshold int, resetTimeout time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold:    threshold,
+		resetTimeout: resetTimeout,
+		circuits:     map[string]*circuit{},
+	}
+}
+
+// wrap returns a RoundTripper that fails fast with errCircuitOpen while the
+// circuit for the request's backend is open.
+func (b *circuitBreaker) wrap(next http.RoundTripper) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		backend := req.URL.Host
+		if !b.allow(backend) {
+			return nil, errCircuitOpen
+		}
+
+		resp, err := next.RoundTrip(req)
+		if req.Context().Err() != nil {
+			// The client went away; that says nothing about the backend
+			b.abandon(backend)
+		} else {
+			b.record(backend, upstreamFailed(resp, err))
+		}
+		return resp, err
+	})
+}
+
+// allow reports whether a request may be sent to backend, moving an open
+// circuit to half-open once the reset timeout has passed.
+func (b *circuitBreaker) allow(backend string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c := b.circuit(backend)
+	switch c.state {
+	case circuitOpen:
+		if time.Since(c.openedAt) < b.resetTimeout {
+			return false
+		}
+		b.transition(backend, c, circuitHalfOpen)
+		c.trial = true
+		return true
+	case circuitHalfOpen:
+		// Only one trial request at a time
+		if c.trial {
+			return false
+		}
+		c.trial = true
+		return true
+	default:
+		return true
+	}
+}
+
+func (b *circuitBreaker) record(backend string, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c := b.circuit(backend)
+	c.trial = false
+	if !failed {
+		c.failures = 0
+		if c.state != circuitClosed {
+			b.transition(backend, c, circuitClosed)
+		}
+		return
+	}
+
+	c.failures++
+	if c.state == circuitHalfOpen || c.failures >= b.threshold {
+		c.openedAt = time.Now()
+		if c.state != circuitOpen {
+			b.transition(backend, c, circuitOpen)
+		}
+	}
+}
+
+// abandon releases a trial slot without counting the outcome.
+func (b *circuitBreaker) abandon(backend string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.circuit(backend).trial = false
+}
+
+func (b *circuitBreaker) circuit(backend string) *circuit {
+	c, ok := b.circuits[backend]
+	if !ok {
+		c = &circuit{}
+		b.circuits[backend] = c
+	}
+	return c
+}
+
+func (b *circuitBreaker) transition(backend string, c *circuit, state circuitState) {
+	if state == circuitOpen {
+		warnf("Circuit for backend %s: %s -> %s after %d consecutive failures", backend, c.state, state, c.failures)
+	} else {
+		infof("Circuit for backend %s: %s -> %s", backend, c.state, state)
+	}
+	c.state = state
+}
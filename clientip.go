@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+type clientIPContext struct{}
+
+// proxiedClient is what withClientIP learns about a request's origin.
+type proxiedClient struct {
+	ip string
+	// viaProxy is set when the connection came from a trusted proxy, so
+	// its X-Forwarded-For chain can be believed.
+	viaProxy bool
+}
+
+// trustedProxies lists the addresses of proxies in front of the relay whose
+// X-Forwarded-For entries are believed.
+type trustedProxies []netip.Prefix
+
+func newTrustedProxies(cidrs []string) (trustedProxies, error) {
+	prefixes, err := parsePrefixes(cidrs)
+	return trustedProxies(prefixes), err
+}
+
+func (t trustedProxies) contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range t {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve finds the client behind a request. When the peer is a trusted
+// proxy, the X-Forwarded-For chain is walked from the right, skipping
+// further trusted hops, and the first untrusted entry is the client. A
+// malformed entry stops the walk, since anything left of it may have been
+// written by the client, and the last hop read is taken as the client.
+func (t trustedProxies) resolve(r *http.Request) proxiedClient {
+	peer := remoteIP(r)
+	addr, err := netip.ParseAddr(peer)
+	if err != nil || !t.contains(addr) {
+		return proxiedClient{ip: peer}
+	}
+
+	var chain []string
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		chain = append(chain, strings.Split(value, ",")...)
+	}
+	client := peer
+	for i := len(chain) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(chain[i]))
+		if err != nil {
+			break
+		}
+		client = hop.Unmap().String()
+		if !t.contains(hop) {
+			break
+		}
+	}
+	return proxiedClient{ip: client, viaProxy: true}
+}
+
+// withClientIP records the real client address on each request so logging,
+// rate limiting, IP rules and X-Real-IP all agree on it. With no trusted
+// proxies it is a passthrough.
+func withClientIP(t trustedProxies, next http.Handler) http.Handler {
+	if len(t) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), clientIPContext{}, t.resolve(r))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// clientIP returns the address of the client without its port, as derived
+// behind trusted proxies when configured.
+func clientIP(r *http.Request) string {
+	if client, ok := r.Context().Value(clientIPContext{}).(proxiedClient); ok {
+		return client.ip
+	}
+	return remoteIP(r)
+}
+
+// viaTrustedProxy reports whether the request arrived through a proxy
+// listed in --trusted-proxies.
+func viaTrustedProxy(r *http.Request) bool {
+	client, _ := r.Context().Value(clientIPContext{}).(proxiedClient)
+	return client.viaProxy
+}
+
+// remoteIP returns the address of the connected peer without its port.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
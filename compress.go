@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// compressibleTypes lists the content types worth gzipping besides text/*.
+// text/event-stream is excluded because buffering would delay events.
+var compressibleTypes = map[string]bool{
+	"application/javascript": true,
+	"application/json":       true,
+	"application/xml":        true,
+	"application/wasm":       true,
+	"image/svg+xml":          true,
+}
+
+var gzipWriters = sync.Pool{
+	New: func() any { return gzip.NewWriter(nil) },
+}
+
+// compressResponse gzips the response body when the client accepts it, the
+// body isn't already encoded, its type compresses well, and it is at least
+// minSize bytes. The body is compressed as it streams to the client.
+func compressResponse(resp *http.Response, minSize int) {
+	if !shouldCompress(resp) {
+		return
+	}
+
+	if resp.ContentLength >= 0 {
+		if resp.ContentLength < int64(minSize) {
+			return
+		}
+	} else if minSize > 0 {
+		// Unknown length; look ahead to see whether the body is big enough
+		buffered := bufio.NewReaderSize(resp.Body, minSize)
+		_, err := buffered.Peek(minSize)
+		resp.Body = readCloser{buffered, resp.Body}
+		if err != nil {
+			return
+		}
+	}
+
+	body := resp.Body
+	pr, pw := io.Pipe()
+	go func() {
+		gz := gzipWriters.Get().(*gzip.Writer)
+		gz.Reset(pw)
+		_, err := io.Copy(gz, body)
+		if closeErr := gz.Close(); err == nil {
+			err = closeErr
+		}
+		gzipWriters.Put(gz)
+		body.Close()
+		pw.CloseWithError(err)
+	}()
+
+	resp.Body = pr
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	resp.Header.Set("Content-Encoding", "gzip")
+	resp.Header.Add("Vary", "Accept-Encoding")
+
+	// The encoded body no longer matches a strong validator
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+}
+
+func shouldCompress(resp *http.Response) bool {
+	if resp.Request.Method == http.MethodHead ||
+		resp.StatusCode == http.StatusNoContent ||
+		resp.StatusCode == http.StatusNotModified ||
+		resp.StatusCode == http.StatusPartialContent {
+		return false
+	}
+	if !acceptsGzip(resp.Request.Header) {
+		return false
+	}
+	if resp.Header.Get("Content-Encoding") != "" ||
+		strings.Contains(resp.Header.Get("Cache-Control"), "no-transform") {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	if mediaType == "text/event-stream" {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") || compressibleTypes[mediaType]
+}
+
+// acceptsGzip reports whether the Accept-Encoding header allows gzip.
+func acceptsGzip(h http.Header) bool {
+	for _, value := range h.Values("Accept-Encoding") {
+		for _, token := range strings.Split(value, ",") {
+			coding, params, _ := strings.Cut(strings.TrimSpace(token), ";")
+			if !strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+				continue
+			}
+			q, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+			if !ok {
+				return true
+			}
+			if weight, err := strconv.ParseFloat(q, 64); err == nil && weight > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// readCloser reads from a buffered view of a body while closing the original.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,1053 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http/httpguts"
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	ConfigFile       string `yaml:"-"`
+	Check            bool   `yaml:"-"`
+	Version          bool   `yaml:"-"`
+	Host             string `yaml:"host"`
+	Port             int    `yaml:"port"`
+	ListenSocket     string `yaml:"listenSocket"`
+	ListenSocketMode string `yaml:"listenSocketMode"`
+	ProxyHost        string `yaml:"proxyHost"`
+	ProxyPort        int    `yaml:"proxyPort"`
+	ProxySocket      string `yaml:"proxySocket"`
+	CertFile         string `yaml:"cert"`
+	KeyFile          string `yaml:"key"`
+	NoTLS            bool   `yaml:"noTLS"`
+	HTTP3            bool   `yaml:"http3"`
+	AltSvc           string `yaml:"altSvc"`
+	HealthPath       string `yaml:"healthPath"`
+
+	SelfSigned      bool     `yaml:"selfSigned"`
+	SelfSignedHosts []string `yaml:"selfSignedHosts"`
+
+	ReadyPath     string        `yaml:"readyPath"`
+	ReadyTimeout  time.Duration `yaml:"readyTimeout"`
+	ReadyCacheTTL time.Duration `yaml:"readyCacheTTL"`
+	StartupWait   time.Duration `yaml:"startupWait"`
+
+	MetricsPath string `yaml:"metricsPath"`
+	StatusPath  string `yaml:"statusPath"`
+	VersionPath string `yaml:"versionPath"`
+	StatusToken string `yaml:"statusToken"`
+	AdminPath   string `yaml:"adminPath"`
+	AdminToken  string `yaml:"adminToken"`
+	PprofAddr   string `yaml:"pprofAddr"`
+
+	LogFormat      string `yaml:"logFormat"`
+	LogLevel       string `yaml:"logLevel"`
+	LogPanicStacks bool   `yaml:"logPanicStacks"`
+	LogFile        string `yaml:"logFile"`
+
+	AccessLogFile       string `yaml:"accessLogFile"`
+	AccessLogMaxSize    int    `yaml:"accessLogMaxSize"`
+	AccessLogMaxBackups int    `yaml:"accessLogMaxBackups"`
+
+	OTLPEndpoint    string `yaml:"otlpEndpoint"`
+	OTelServiceName string `yaml:"otelServiceName"`
+
+	ReadTimeout       time.Duration `yaml:"readTimeout"`
+	ReadHeaderTimeout time.Duration `yaml:"readHeaderTimeout"`
+	WriteTimeout      time.Duration `yaml:"writeTimeout"`
+	IdleTimeout       time.Duration `yaml:"idleTimeout"`
+	ShutdownTimeout   time.Duration `yaml:"shutdownTimeout"`
+	UpstreamTimeout   time.Duration `yaml:"upstreamTimeout"`
+
+	HTTPRedirectPort int `yaml:"httpRedirectPort"`
+
+	MinTLSVersion string   `yaml:"minTLSVersion"`
+	CipherSuites  []string `yaml:"cipherSuites"`
+	ClientCAFile  string   `yaml:"clientCA"`
+
+	CertReloadInterval time.Duration `yaml:"certReloadInterval"`
+	StrictCertValidity bool          `yaml:"strictCertValidity"`
+	CertExpiryWarning  time.Duration `yaml:"certExpiryWarning"`
+	CertExpiryInterval time.Duration `yaml:"certExpiryInterval"`
+
+	ACMEDomains  []string `yaml:"acmeDomains"`
+	ACMECacheDir string   `yaml:"acmeCacheDir"`
+	ACMEEmail    string   `yaml:"acmeEmail"`
+
+	BackendHTTP2       bool `yaml:"backendHTTP2"`
+	PreserveHeaderCase bool `yaml:"preserveHeaderCase"`
+
+	BackendTLS                bool   `yaml:"backendTLS"`
+	BackendInsecureSkipVerify bool   `yaml:"backendInsecureSkipVerify"`
+	BackendCAFile             string `yaml:"backendCA"`
+	BackendServerName         string `yaml:"backendServerName"`
+
+	CanaryBackend string  `yaml:"canaryBackend"`
+	CanaryPercent float64 `yaml:"canaryPercent"`
+	CanaryCookie  string  `yaml:"canaryCookie"`
+
+	MirrorBackend string  `yaml:"mirrorBackend"`
+	MirrorPercent float64 `yaml:"mirrorPercent"`
+
+	UpstreamMaxIdleConns        int           `yaml:"upstreamMaxIdleConns"`
+	UpstreamMaxIdleConnsPerHost int           `yaml:"upstreamMaxIdleConnsPerHost"`
+	UpstreamIdleConnTimeout     time.Duration `yaml:"upstreamIdleConnTimeout"`
+	UpstreamDisableKeepAlives   bool          `yaml:"upstreamDisableKeepAlives"`
+	UpstreamTCPKeepAlive        time.Duration `yaml:"upstreamTCPKeepAlive"`
+
+	DNSCacheTTL      time.Duration `yaml:"dnsCacheTTL"`
+	BackendLocalAddr string        `yaml:"backendLocalAddr"`
+
+	Routes             []RouteConfig           `yaml:"routes"`
+	Domains            map[string]DomainConfig `yaml:"domains"`
+	RejectUnknownHosts bool                    `yaml:"rejectUnknownHosts"`
+	StripPrefix        string                  `yaml:"stripPrefix"`
+	MountPath          string                  `yaml:"mountPath"`
+	PublicHost         string                  `yaml:"publicHost"`
+
+	AddRequestHeaders     []string `yaml:"addRequestHeaders"`
+	RemoveRequestHeaders  []string `yaml:"removeRequestHeaders"`
+	AddResponseHeaders    []string `yaml:"addResponseHeaders"`
+	RemoveResponseHeaders []string `yaml:"removeResponseHeaders"`
+	TrustForwardedFor     bool     `yaml:"trustForwardedFor"`
+	TrustedProxies        []string `yaml:"trustedProxies"`
+
+	OmitForwardedHeaders bool   `yaml:"omitForwardedHeaders"`
+	ForwardedHostHeader  string `yaml:"forwardedHostHeader"`
+	ForwardedProtoHeader string `yaml:"forwardedProtoHeader"`
+	RealIPHeader         string `yaml:"realIPHeader"`
+
+	SecurityHeaders         bool          `yaml:"securityHeaders"`
+	SecurityHeadersOverride bool          `yaml:"securityHeadersOverride"`
+	HSTSMaxAge              time.Duration `yaml:"hstsMaxAge"`
+
+	RewriteBody []string `yaml:"rewriteBody"`
+
+	FlushInterval time.Duration `yaml:"flushInterval"`
+	BufferSize    int           `yaml:"bufferSize"`
+
+	Compress        bool `yaml:"compress"`
+	CompressMinSize int  `yaml:"compressMinSize"`
+
+	CacheTTL     time.Duration `yaml:"cacheTTL"`
+	CacheMaxSize int64         `yaml:"cacheMaxSize"`
+
+	StaticExtensions   []string `yaml:"staticExtensions"`
+	StaticCacheControl string   `yaml:"staticCacheControl"`
+
+	ForceMimeOverride bool              `yaml:"forceMimeOverride"`
+	MimeTypes         map[string]string `yaml:"mimeTypes"`
+
+	MaxConnections        int           `yaml:"maxConnections"`
+	ConnectionMaxLifetime time.Duration `yaml:"connectionMaxLifetime"`
+
+	RateLimit float64 `yaml:"rateLimit"`
+	RateBurst int     `yaml:"rateBurst"`
+
+	AllowCIDRs []string `yaml:"allowCIDRs"`
+	DenyCIDRs  []string `yaml:"denyCIDRs"`
+
+	CORSAllowedOrigins []string `yaml:"corsAllowedOrigins"`
+	CORSAllowedMethods []string `yaml:"corsAllowedMethods"`
+	CORSAllowedHeaders []string `yaml:"corsAllowedHeaders"`
+
+	BasicAuthUser           string `yaml:"basicAuthUser"`
+	BasicAuthPass           string `yaml:"basicAuthPass"`
+	BasicAuthExemptBuiltins bool   `yaml:"basicAuthExemptBuiltins"`
+
+	MaxRequestBody  int64 `yaml:"maxRequestBody"`
+	MaxHeaderBytes  int   `yaml:"maxHeaderBytes"`
+	MaxBufferedBody int64 `yaml:"maxBufferedBody"`
+
+	AllowMethods      []string `yaml:"allowMethods"`
+	AllowConnect      bool     `yaml:"allowConnect"`
+	PathNormalization string   `yaml:"pathNormalization"`
+
+	TrailingSlash      string   `yaml:"trailingSlash"`
+	TrailingSlashPaths []string `yaml:"trailingSlashPaths"`
+
+	ErrorPage string `yaml:"errorPage"`
+
+	Maintenance           bool          `yaml:"maintenance"`
+	MaintenancePage       string        `yaml:"maintenancePage"`
+	MaintenanceRetryAfter time.Duration `yaml:"maintenanceRetryAfter"`
+	MaintenanceFailReady  bool          `yaml:"maintenanceFailReady"`
+
+	RemapStatus []string `yaml:"remapStatus"`
+
+	RetryAttempts int           `yaml:"retryAttempts"`
+	RetryBackoff  time.Duration `yaml:"retryBackoff"`
+
+	CircuitFailureThreshold int           `yaml:"circuitFailureThreshold"`
+	CircuitResetTimeout     time.Duration `yaml:"circuitResetTimeout"`
+
+	HealthCheckInterval time.Duration `yaml:"healthCheckInterval"`
+	HealthCheckPath     string        `yaml:"healthCheckPath"`
+	HealthCheckTimeout  time.Duration `yaml:"healthCheckTimeout"`
+	HealthCheckRise     int           `yaml:"healthCheckRise"`
+	HealthCheckFall     int           `yaml:"healthCheckFall"`
+
+	StickySessions   bool          `yaml:"stickySessions"`
+	StickyCookieName string        `yaml:"stickyCookieName"`
+	StickyCookieTTL  time.Duration `yaml:"stickyCookieTTL"`
+}
+
+// defaultConfig returns a Config populated with the defaults for optional
+// settings.
+func defaultConfig() *Config {
+	return &Config{
+		HealthPath:     "/healthz",
+		ReadyPath:      "/readyz",
+		ReadyTimeout:   2 * time.Second,
+		ReadyCacheTTL:  time.Second,
+		LogFormat:      "text",
+		LogLevel:       "info",
+		LogPanicStacks: true,
+
+		AccessLogMaxSize: 100,
+		OTelServiceName:  "jnb-relay",
+		ReadTimeout:      15 * time.Second,
+		WriteTimeout:     15 * time.Second,
+		IdleTimeout:      60 * time.Second,
+		ShutdownTimeout:  15 * time.Second,
+		MinTLSVersion:    "1.2",
+
+		ListenSocketMode:    "0660",
+		CertReloadInterval:  30 * time.Second,
+		CertExpiryWarning:   14 * 24 * time.Hour,
+		CertExpiryInterval:  12 * time.Hour,
+		ACMECacheDir:        "acme-cache",
+		CompressMinSize:     1024,
+		CacheMaxSize:        64 << 20,
+		MaxHeaderBytes:      http.DefaultMaxHeaderBytes,
+		MaxBufferedBody:     10 << 20,
+		PathNormalization:   "strict",
+		MirrorPercent:       100,
+		TrailingSlash:       "off",
+		RetryBackoff:        100 * time.Millisecond,
+		CircuitResetTimeout: 30 * time.Second,
+		HealthCheckTimeout:  2 * time.Second,
+		HealthCheckRise:     2,
+		HealthCheckFall:     3,
+		StickyCookieName:    "jnbrelay_backend",
+
+		// A relay usually talks to one or a few backends, so keep far more
+		// idle connections per host than net/http's default of 2
+		UpstreamMaxIdleConns:        256,
+		UpstreamMaxIdleConnsPerHost: 64,
+		UpstreamIdleConnTimeout:     90 * time.Second,
+		UpstreamTCPKeepAlive:        30 * time.Second,
+
+		ForwardedHostHeader:  "X-Forwarded-Host",
+		ForwardedProtoHeader: "X-Forwarded-Proto",
+		RealIPHeader:         "X-Real-IP",
+
+		HSTSMaxAge:         365 * 24 * time.Hour,
+		CORSAllowedMethods: []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"},
+		StaticExtensions: []string{
+			".css", ".js", ".mjs", ".map",
+			".png", ".jpg", ".jpeg", ".gif", ".svg", ".ico", ".webp",
+			".woff", ".woff2", ".ttf", ".wasm",
+		},
+		MaintenanceRetryAfter: 5 * time.Minute,
+	}
+}
+
+// defineFlags registers every command line flag on fs, bound to the matching
+// field of config. The current field values are used as flag defaults, so
+// binding to a config loaded from a file keeps the file values unless the
+// flag is explicitly set.
+func defineFlags(fs *flag.FlagSet, config *Config) {
+	fs.StringVar(&config.ConfigFile, "config", config.ConfigFile, "Path to a YAML or JSON config file (optional)")
+	fs.BoolVar(&config.Check, "check", config.Check, "Validate the configuration, backends and certificate files, then exit without starting the server")
+	fs.BoolVar(&config.Version, "version", config.Version, "Print the version, commit and build date, then exit")
+	fs.StringVar(&config.Host, "host", config.Host, "Host address to listen on, or a comma-separated list of addresses to listen on all of (required unless --listen-socket is set)")
+	fs.IntVar(&config.Port, "port", config.Port, "Port to listen on, 0 for a free port picked by the OS (required unless --listen-socket is set)")
+	fs.StringVar(&config.ListenSocket, "listen-socket", config.ListenSocket, "Path of a Unix socket to serve on instead of --host and --port; TLS is used only if --cert and --key are set")
+	fs.StringVar(&config.ListenSocketMode, "listen-socket-mode", config.ListenSocketMode, "Octal permissions for the --listen-socket file")
+	fs.StringVar(&config.ProxyHost, "proxy-for-host", config.ProxyHost, "Host to proxy requests to, or a comma-separated list of host[:port] backends to balance across (required unless --proxy-for-socket is set)")
+	fs.IntVar(&config.ProxyPort, "proxy-for-port", config.ProxyPort, "Port to proxy requests to, used for backends without their own port (required unless every backend has a port or --proxy-for-socket is set)")
+	fs.StringVar(&config.ProxySocket, "proxy-for-socket", config.ProxySocket, "Path to a Unix socket to proxy requests to instead of --proxy-for-host and --proxy-for-port")
+	fs.StringVar(&config.CertFile, "cert", config.CertFile, "Path to TLS certificate file (required unless --acme-domains, --no-tls or --self-signed is set)")
+	fs.StringVar(&config.KeyFile, "key", config.KeyFile, "Path to TLS key file (required unless --acme-domains, --no-tls or --self-signed is set)")
+	fs.BoolVar(&config.NoTLS, "no-tls", config.NoTLS, "Serve plain HTTP without --cert and --key, for local development only")
+	fs.BoolVar(&config.HTTP3, "http3", config.HTTP3, "Also serve HTTP/3 over QUIC on --port (UDP) and advertise it to clients with Alt-Svc")
+	fs.StringVar(&config.AltSvc, "alt-svc", config.AltSvc, "Alt-Svc header to set on proxied responses, e.g. 'h3=\":443\"; ma=86400', replacing the backend's and the one --http3 sends")
+	fs.BoolVar(&config.SelfSigned, "self-signed", config.SelfSigned, "Generate an in-memory self-signed certificate for --host instead of loading --cert and --key, for demos and throwaway setups")
+	fs.Var(&listValue{list: &config.SelfSignedHosts}, "self-signed-hosts", "Comma-separated extra DNS names and IP addresses for the --self-signed certificate (repeatable)")
+	fs.StringVar(&config.HealthPath, "health-path", config.HealthPath, "Path of the built-in health check endpoint, empty to disable")
+	fs.StringVar(&config.ReadyPath, "ready-path", config.ReadyPath, "Path of the readiness endpoint that probes the backend, empty to disable")
+	fs.DurationVar(&config.ReadyTimeout, "ready-timeout", config.ReadyTimeout, "Timeout for each backend readiness probe")
+	fs.DurationVar(&config.ReadyCacheTTL, "ready-cache-ttl", config.ReadyCacheTTL, "How long a readiness probe result is reused before probing again")
+	fs.DurationVar(&config.StartupWait, "startup-wait", config.StartupWait, "Report not ready after startup until a backend accepts a connection, waiting at most this long; 0 disables the wait")
+	fs.StringVar(&config.MetricsPath, "metrics-path", config.MetricsPath, "Path to serve Prometheus metrics on, e.g. /metrics (disabled when empty)")
+	fs.StringVar(&config.StatusPath, "status-path", config.StatusPath, "Path to serve a status page with uptime, traffic, backend health and cache stats on, e.g. /status (disabled when empty)")
+	fs.StringVar(&config.VersionPath, "version-path", config.VersionPath, "Path to serve the version, commit and build date on as JSON, e.g. /version (disabled when empty)")
+	fs.StringVar(&config.StatusToken, "status-token", config.StatusToken, "Bearer token required to view --status-path; prefer JNBRELAY_STATUS_TOKEN to keep it out of the process list")
+	fs.StringVar(&config.AdminPath, "admin-path", config.AdminPath, "Path prefix of the admin API for draining backends and maintenance mode, e.g. /admin (disabled when empty)")
+	fs.StringVar(&config.AdminToken, "admin-token", config.AdminToken, "Bearer token required by the admin API; prefer JNBRELAY_ADMIN_TOKEN to keep it out of the process list")
+	fs.StringVar(&config.PprofAddr, "pprof-addr", config.PprofAddr, "Address for a separate plain HTTP listener serving pprof profiles, e.g. localhost:6060 (disabled when empty)")
+	fs.StringVar(&config.LogFormat, "log-format", config.LogFormat, "Log output format: text or json")
+	fs.StringVar(&config.LogLevel, "log-level", config.LogLevel, "Minimum level to log: debug, info, warn or error")
+	fs.BoolVar(&config.LogPanicStacks, "log-panic-stacks", config.LogPanicStacks, "Include the stack trace when logging a panic recovered while serving a request; pass --log-panic-stacks=false to log only the panic value")
+	fs.StringVar(&config.LogFile, "log-file", config.LogFile, "File to write application logs to instead of stderr; reopened on SIGHUP")
+	fs.StringVar(&config.AccessLogFile, "access-log-file", config.AccessLogFile, "File to write access logs to instead of the application log; reopened on SIGHUP")
+	fs.IntVar(&config.AccessLogMaxSize, "access-log-max-size", config.AccessLogMaxSize, "Size in megabytes at which --access-log-file is rotated")
+	fs.IntVar(&config.AccessLogMaxBackups, "access-log-max-backups", config.AccessLogMaxBackups, "Rotated access log files to keep, 0 to keep all")
+	fs.StringVar(&config.OTLPEndpoint, "otlp-endpoint", config.OTLPEndpoint, "OTLP/HTTP collector URL to export traces to, e.g. http://localhost:4318; tracing is disabled when empty")
+	fs.StringVar(&config.OTelServiceName, "otel-service-name", config.OTelServiceName, "Service name reported in exported traces")
+	fs.DurationVar(&config.ReadTimeout, "read-timeout", config.ReadTimeout, "Maximum time to read an entire client request, 0 for no limit")
+	fs.DurationVar(&config.ReadHeaderTimeout, "read-header-timeout", config.ReadHeaderTimeout, "Maximum time to read client request headers, 0 to use --read-timeout")
+	fs.DurationVar(&config.WriteTimeout, "write-timeout", config.WriteTimeout, "Maximum time to write a response to the client, 0 for no limit")
+	fs.DurationVar(&config.IdleTimeout, "idle-timeout", config.IdleTimeout, "Maximum time to keep an idle keep-alive connection open, 0 to use --read-timeout")
+	fs.DurationVar(&config.UpstreamTimeout, "upstream-timeout", config.UpstreamTimeout, "Maximum time for a backend to send a complete response before the client gets 504, 0 for no limit")
+	fs.DurationVar(&config.ShutdownTimeout, "shutdown-timeout", config.ShutdownTimeout, "Maximum time to wait for in-flight requests to finish on SIGINT or SIGTERM")
+	fs.IntVar(&config.HTTPRedirectPort, "http-redirect-port", config.HTTPRedirectPort, "Port for a plain HTTP listener that redirects to HTTPS (disabled when 0)")
+	fs.StringVar(&config.MinTLSVersion, "min-tls-version", config.MinTLSVersion, "Minimum TLS version to accept: 1.2 or 1.3")
+	fs.Var(&listValue{list: &config.CipherSuites}, "cipher-suites", "Comma-separated TLS 1.2 cipher suite names to allow (default Go's secure suites)")
+	fs.StringVar(&config.ClientCAFile, "client-ca", config.ClientCAFile, "Path to a PEM CA bundle; when set, clients must present a certificate signed by it")
+	fs.BoolVar(&config.StrictCertValidity, "strict-cert-validity", config.StrictCertValidity, "Refuse to start with or reload a certificate that is expired or not yet valid, instead of logging a warning")
+	fs.DurationVar(&config.CertExpiryWarning, "cert-expiry-warning", config.CertExpiryWarning, "Log a warning when a certificate loaded from disk expires within this long")
+	fs.DurationVar(&config.CertExpiryInterval, "cert-expiry-check-interval", config.CertExpiryInterval, "How often to check certificates for --cert-expiry-warning, 0 to disable the check")
+	fs.DurationVar(&config.CertReloadInterval, "cert-reload-interval", config.CertReloadInterval, "How often to check the certificate and key files for changes, 0 to disable reloading")
+	fs.Var(&listValue{list: &config.ACMEDomains}, "acme-domains", "Comma-separated domains to obtain certificates for from Let's Encrypt instead of using --cert and --key")
+	fs.StringVar(&config.ACMECacheDir, "acme-cache-dir", config.ACMECacheDir, "Directory to cache ACME certificates in")
+	fs.StringVar(&config.ACMEEmail, "acme-email", config.ACMEEmail, "Contact email for the ACME account (optional)")
+	fs.StringVar(&config.MountPath, "mount-path", config.MountPath, "Path prefix the relay is hosted under, e.g. /service; it is removed before forwarding and added back to backend redirects")
+	fs.StringVar(&config.PublicHost, "public-host", config.PublicHost, "Host, with an optional port, that backend redirects to the backend's own address are rewritten to (default the Host the client used)")
+	fs.BoolVar(&config.RejectUnknownHosts, "reject-unknown-hosts", config.RejectUnknownHosts, "Answer requests for hosts not listed under domains in the config file with 404 instead of proxying them to the default backends")
+	fs.StringVar(&config.StripPrefix, "strip-prefix", config.StripPrefix, "Path prefix to remove before forwarding, e.g. /api turns /api/users into /users")
+	fs.Var(&repeatedValue{list: &config.AddRequestHeaders}, "add-request-header", "Header to add to requests sent to the backend as \"Name: Value\" (repeatable)")
+	fs.Var(&listValue{list: &config.RemoveRequestHeaders}, "remove-request-header", "Comma-separated header names to remove from requests sent to the backend (repeatable)")
+	fs.Var(&repeatedValue{list: &config.AddResponseHeaders}, "add-response-header", "Header to add to responses sent to the client as \"Name: Value\" (repeatable)")
+	fs.Var(&listValue{list: &config.RemoveResponseHeaders}, "remove-response-header", "Comma-separated header names to remove from responses sent to the client (repeatable)")
+	fs.BoolVar(&config.TrustForwardedFor, "trust-forwarded-for", config.TrustForwardedFor, "Extend an X-Forwarded-For header sent by the client instead of replacing it; only enable behind a trusted proxy")
+	fs.Var(&listValue{list: &config.TrustedProxies}, "trusted-proxies", "Comma-separated CIDR blocks of proxies in front of the relay; for their requests the client is the rightmost untrusted X-Forwarded-For entry (repeatable)")
+	fs.BoolVar(&config.OmitForwardedHeaders, "omit-forwarded-headers", config.OmitForwardedHeaders, "Pass the client's X-Forwarded-* and X-Real-IP headers through instead of setting them, for relays behind a proxy that manages them")
+	fs.StringVar(&config.ForwardedHostHeader, "forwarded-host-header", config.ForwardedHostHeader, "Name of the header that carries the forwarded host, empty to leave it out")
+	fs.StringVar(&config.ForwardedProtoHeader, "forwarded-proto-header", config.ForwardedProtoHeader, "Name of the header that carries the forwarded scheme, empty to leave it out")
+	fs.StringVar(&config.RealIPHeader, "real-ip-header", config.RealIPHeader, "Name of the header that carries the client's IP address, empty to leave it out")
+	fs.BoolVar(&config.SecurityHeaders, "security-headers", config.SecurityHeaders, "Add Strict-Transport-Security, X-Content-Type-Options, X-Frame-Options and Referrer-Policy to responses")
+	fs.BoolVar(&config.SecurityHeadersOverride, "security-headers-override", config.SecurityHeadersOverride, "Replace security headers the backend already set instead of keeping them")
+	fs.DurationVar(&config.HSTSMaxAge, "hsts-max-age", config.HSTSMaxAge, "max-age sent in Strict-Transport-Security by --security-headers")
+	fs.Var(&repeatedValue{list: &config.RewriteBody}, "rewrite-body", "Replace text in HTML and CSS responses, given as \"from=>to\" (repeatable)")
+	fs.DurationVar(&config.FlushInterval, "flush-interval", config.FlushInterval, "How often to flush buffered response data to the client, negative to flush after every write (disabled when 0)")
+	fs.IntVar(&config.BufferSize, "buffer-size", config.BufferSize, "Size in bytes of the pooled buffers response bodies are copied through (default 32768)")
+	fs.BoolVar(&config.Compress, "compress", config.Compress, "Gzip compressible responses for clients that accept it")
+	fs.IntVar(&config.CompressMinSize, "compress-min-size", config.CompressMinSize, "Smallest response body in bytes that --compress will gzip")
+	fs.DurationVar(&config.CacheTTL, "cache-ttl", config.CacheTTL, "How long to cache static asset responses in memory, 0 to disable caching")
+	fs.Int64Var(&config.CacheMaxSize, "cache-max-size", config.CacheMaxSize, "Maximum total size in bytes of cached response bodies")
+	fs.Var(&listValue{list: &config.StaticExtensions}, "static-extensions", "Comma-separated file extensions treated as static assets by --cache-ttl and --static-cache-control")
+	fs.StringVar(&config.StaticCacheControl, "static-cache-control", config.StaticCacheControl, "Cache-Control value for static assets that don't set one, e.g. \"public, max-age=31536000\"")
+	fs.BoolVar(&config.ForceMimeOverride, "force-mime-override", config.ForceMimeOverride, "Always replace Content-Type with the type derived from the file extension, not only when it is missing or generic")
+	fs.IntVar(&config.MaxConnections, "max-connections", config.MaxConnections, "Maximum client connections open at once across all listen addresses; further connections wait (disabled when 0)")
+	fs.DurationVar(&config.ConnectionMaxLifetime, "connection-max-lifetime", config.ConnectionMaxLifetime, "Close client connections older than this after their current request, so clients reconnect and rebalance (disabled when 0)")
+	fs.Float64Var(&config.RateLimit, "rate-limit", config.RateLimit, "Requests per second allowed from each client IP, 0 to disable rate limiting")
+	fs.IntVar(&config.RateBurst, "rate-burst", config.RateBurst, "Requests a client may make in a burst above --rate-limit (default the rate, rounded up)")
+	fs.Var(&listValue{list: &config.AllowCIDRs}, "allow-cidr", "Comma-separated CIDR blocks allowed to use the relay; others get 403 (repeatable)")
+	fs.Var(&listValue{list: &config.DenyCIDRs}, "deny-cidr", "Comma-separated CIDR blocks refused with 403, taking precedence over --allow-cidr (repeatable)")
+	fs.Var(&listValue{list: &config.CORSAllowedOrigins}, "cors-allowed-origins", "Comma-separated origins allowed to make cross-origin requests, or * for any; enables CORS handling")
+	fs.Var(&listValue{list: &config.CORSAllowedMethods}, "cors-allowed-methods", "Comma-separated methods allowed in cross-origin requests")
+	fs.Var(&listValue{list: &config.CORSAllowedHeaders}, "cors-allowed-headers", "Comma-separated request headers allowed in cross-origin requests")
+	fs.StringVar(&config.BasicAuthUser, "basic-auth-user", config.BasicAuthUser, "Require HTTP Basic authentication with this user name")
+	fs.StringVar(&config.BasicAuthPass, "basic-auth-pass", config.BasicAuthPass, "Password for --basic-auth-user; prefer JNBRELAY_BASIC_AUTH_PASS to keep it out of the process list")
+	fs.BoolVar(&config.BasicAuthExemptBuiltins, "basic-auth-exempt-builtins", config.BasicAuthExemptBuiltins, "Serve the health, readiness and metrics endpoints without basic auth")
+	fs.StringVar(&config.ErrorPage, "error-page", config.ErrorPage, "Path to an HTML template served when the backend cannot be reached; JSON clients get a JSON error instead")
+	fs.BoolVar(&config.Maintenance, "maintenance", config.Maintenance, "Start in maintenance mode, answering proxied requests with 503 until it is switched off with SIGUSR1 or the admin API")
+	fs.StringVar(&config.MaintenancePage, "maintenance-page", config.MaintenancePage, "Path to an HTML template served in maintenance mode; JSON clients get a JSON error instead")
+	fs.DurationVar(&config.MaintenanceRetryAfter, "maintenance-retry-after", config.MaintenanceRetryAfter, "Retry-After sent with maintenance responses, 0 to leave it out")
+	fs.BoolVar(&config.MaintenanceFailReady, "maintenance-fail-ready", config.MaintenanceFailReady, "Report not ready on --ready-path in maintenance mode, so load balancers send traffic elsewhere")
+	fs.Var(&listValue{list: &config.RemapStatus}, "remap-status", "Comma-separated from=to rules replacing backend response statuses, e.g. 520=502 (repeatable)")
+	fs.Int64Var(&config.MaxRequestBody, "max-request-body", config.MaxRequestBody, "Largest request body in bytes to forward; larger requests get 413 (disabled when 0)")
+	fs.IntVar(&config.MaxHeaderBytes, "max-header-bytes", config.MaxHeaderBytes, "Largest request line and headers in bytes a client may send; larger requests get 431")
+	fs.Int64Var(&config.MaxBufferedBody, "max-buffered-body", config.MaxBufferedBody, "Largest response body in bytes held in memory for --rewrite-body or --cache-ttl; larger responses are streamed through unchanged")
+	fs.Var(&listValue{list: &config.AllowMethods}, "allow-methods", "Comma-separated request methods to forward, e.g. GET,HEAD,OPTIONS; others get 405 (default all)")
+	fs.BoolVar(&config.AllowConnect, "allow-connect", config.AllowConnect, "Answer HTTP/1.1 CONNECT requests with a raw TCP tunnel to the default backends, for fronting a TCP service")
+	fs.StringVar(&config.PathNormalization, "path-normalization", config.PathNormalization, "How request paths are cleaned before forwarding: strict rejects .. segments and null bytes with 400, clean resolves .. segments instead, off forwards paths as sent")
+	fs.StringVar(&config.TrailingSlash, "trailing-slash", config.TrailingSlash, "Redirect paths to the variant with a trailing slash (add) or without one (remove) before proxying, or leave them as sent (off)")
+	fs.Var(&listValue{list: &config.TrailingSlashPaths}, "trailing-slash-paths", "Comma-separated path prefixes --trailing-slash applies to (repeatable, default all paths)")
+	fs.IntVar(&config.RetryAttempts, "retry-attempts", config.RetryAttempts, "Times to retry GET and HEAD requests that fail to reach the backend or get a 502 or 503, 0 to disable retries")
+	fs.DurationVar(&config.RetryBackoff, "retry-backoff", config.RetryBackoff, "Base delay before the first retry; later retries double it, with jitter")
+	fs.IntVar(&config.CircuitFailureThreshold, "circuit-failure-threshold", config.CircuitFailureThreshold, "Consecutive failures after which a backend is refused with 503 for --circuit-reset-timeout, 0 to disable the circuit breaker")
+	fs.DurationVar(&config.CircuitResetTimeout, "circuit-reset-timeout", config.CircuitResetTimeout, "How long an open circuit refuses requests before a trial request is let through")
+	fs.DurationVar(&config.HealthCheckInterval, "health-check-interval", config.HealthCheckInterval, "How often to health check each backend, taking failing ones out of rotation (disabled when 0)")
+	fs.StringVar(&config.HealthCheckPath, "health-check-path", config.HealthCheckPath, "Path to GET for backend health checks; any status below 500 is healthy (default a TCP connect)")
+	fs.DurationVar(&config.HealthCheckTimeout, "health-check-timeout", config.HealthCheckTimeout, "Timeout for each backend health check")
+	fs.IntVar(&config.HealthCheckRise, "health-check-rise", config.HealthCheckRise, "Successful health checks in a row before a down backend rejoins the rotation")
+	fs.IntVar(&config.HealthCheckFall, "health-check-fall", config.HealthCheckFall, "Failed health checks in a row before a backend is taken out of rotation")
+	fs.BoolVar(&config.StickySessions, "sticky-sessions", config.StickySessions, "Send each client back to the backend that served it, tracked with a cookie, while that backend is up")
+	fs.StringVar(&config.StickyCookieName, "sticky-cookie-name", config.StickyCookieName, "Name of the --sticky-sessions cookie")
+	fs.DurationVar(&config.StickyCookieTTL, "sticky-cookie-ttl", config.StickyCookieTTL, "Lifetime of the --sticky-sessions cookie (default until the browser closes)")
+	fs.BoolVar(&config.BackendHTTP2, "backend-http2", config.BackendHTTP2, "Speak cleartext HTTP/2 (h2c) to the backends instead of HTTP/1.1")
+	fs.StringVar(&config.CanaryBackend, "canary-backend", config.CanaryBackend, "Comma-separated host[:port] backends of a new version to send --canary-percent of the requests for the default backends to")
+	fs.Float64Var(&config.CanaryPercent, "canary-percent", config.CanaryPercent, "Percentage of requests for the default backends that go to --canary-backend; can be changed with a config reload")
+	fs.StringVar(&config.CanaryCookie, "canary-cookie", config.CanaryCookie, "Name of a cookie that pins each client to the canary or the stable version (default no pinning)")
+	fs.StringVar(&config.MirrorBackend, "mirror-backend", config.MirrorBackend, "Comma-separated host[:port] shadow backends to send copies of requests to; their responses are discarded (disabled when empty)")
+	fs.Float64Var(&config.MirrorPercent, "mirror-percent", config.MirrorPercent, "Percentage of requests to copy to --mirror-backend")
+	fs.BoolVar(&config.PreserveHeaderCase, "preserve-header-case", config.PreserveHeaderCase, "Send response header names to HTTP/1.1 clients spelled as the backend sent them instead of in canonical form, for legacy clients")
+	fs.BoolVar(&config.BackendTLS, "backend-tls", config.BackendTLS, "Connect to the backends over HTTPS instead of plain HTTP")
+	fs.BoolVar(&config.BackendInsecureSkipVerify, "backend-insecure-skip-verify", config.BackendInsecureSkipVerify, "Accept any certificate from --backend-tls backends, e.g. a self-signed one; the connection is encrypted but not authenticated")
+	fs.StringVar(&config.BackendCAFile, "backend-ca", config.BackendCAFile, "Path to a PEM CA bundle to verify --backend-tls backends against instead of the system roots")
+	fs.StringVar(&config.BackendServerName, "backend-server-name", config.BackendServerName, "Host name to send as SNI and verify --backend-tls certificates against (default each backend's host from --proxy-for-host)")
+	fs.IntVar(&config.UpstreamMaxIdleConns, "upstream-max-idle-conns", config.UpstreamMaxIdleConns, "Maximum idle keep-alive connections kept to all backends, 0 for no limit")
+	fs.IntVar(&config.UpstreamMaxIdleConnsPerHost, "upstream-max-idle-conns-per-host", config.UpstreamMaxIdleConnsPerHost, "Maximum idle keep-alive connections kept to each backend")
+	fs.DurationVar(&config.UpstreamIdleConnTimeout, "upstream-idle-conn-timeout", config.UpstreamIdleConnTimeout, "How long an idle backend connection is kept open, 0 for no limit; keep it below the backend's keep-alive timeout")
+	fs.BoolVar(&config.UpstreamDisableKeepAlives, "upstream-disable-keepalives", config.UpstreamDisableKeepAlives, "Open a new backend connection for every request")
+	fs.DurationVar(&config.UpstreamTCPKeepAlive, "upstream-tcp-keepalive", config.UpstreamTCPKeepAlive, "Interval of TCP keep-alive probes on backend connections, which stop middleboxes from dropping idle ones; 0 to turn the probes off")
+	fs.DurationVar(&config.DNSCacheTTL, "dns-cache-ttl", config.DNSCacheTTL, "How long resolved backend addresses are reused before resolving the name again, 0 to resolve on every new connection")
+	fs.StringVar(&config.BackendLocalAddr, "backend-local-addr", config.BackendLocalAddr, "Local IP address that backend connections originate from, for multi-homed hosts (default chosen by the OS)")
+}
+
+func parseFlags() *Config {
+	config := defaultConfig()
+
+	// Define flags
+	defineFlags(flag.CommandLine, config)
+
+	// Custom usage message
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Flags marked required must be set on the command line, in the config file or via the environment:\n")
+		flag.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nEnvironment variables:\n")
+		for _, env := range envVars {
+			fmt.Fprintf(os.Stderr, "  %s\t--%s\n", env.name, env.flag)
+		}
+		fmt.Fprintf(os.Stderr, "\nExample:\n")
+		fmt.Fprintf(os.Stderr, "  %s --host 0.0.0.0 --port 443 --proxy-for-host 127.0.0.1 --proxy-for-port 8443 --cert cert.crt --key key.pem\n", os.Args[0])
+	}
+
+	flag.Parse()
+
+	config, err := mergeConfig(config.ConfigFile, os.Args[1:])
+	var missing missingFlagsError
+	if errors.As(err, &missing) {
+		fmt.Fprintf(os.Stderr, "Error: %v\n\n", err)
+		flag.Usage()
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	return config
+}
+
+// flagSet reports whether the named flag was set on the command line or
+// from the environment.
+func flagSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// missingFlagsError lists required flags that were not set anywhere.
+type missingFlagsError []string
+
+func (e missingFlagsError) Error() string {
+	return fmt.Sprintf("missing required flags: %v", []string(e))
+}
+
+// mergeConfig builds the configuration from the defaults, the config file,
+// the environment and the command line args, in increasing order of
+// precedence, and validates it. It runs at startup and again on reload.
+func mergeConfig(configFile string, args []string) (*Config, error) {
+	config := defaultConfig()
+	if configFile != "" {
+		fileConfig, err := loadConfigFile(configFile)
+		if err != nil {
+			return nil, err
+		}
+		config = fileConfig
+	}
+
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	defineFlags(fs, config)
+	if err := applyEnv(fs); err != nil {
+		return nil, err
+	}
+
+	// Parse the command line again on top of the file and environment
+	// values so that explicitly set flags take precedence
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if config.Version {
+		return config, nil
+	}
+
+	// Verify all required flags are provided
+	var missingFlags missingFlagsError
+
+	if config.ListenSocket == "" {
+		if config.Host == "" {
+			missingFlags = append(missingFlags, "host")
+		}
+		// An explicit --port 0 asks for an ephemeral port
+		if config.Port == 0 && !flagSet(fs, "port") {
+			missingFlags = append(missingFlags, "port")
+		}
+	}
+	if config.ProxySocket == "" {
+		if config.ProxyHost == "" {
+			missingFlags = append(missingFlags, "proxy-for-host")
+		}
+		if config.ProxyPort == 0 && !backendsHavePorts(config.ProxyHost) {
+			missingFlags = append(missingFlags, "proxy-for-port")
+		}
+	}
+	if len(config.ACMEDomains) == 0 && config.ListenSocket == "" && !config.NoTLS && !config.SelfSigned {
+		if config.CertFile == "" {
+			missingFlags = append(missingFlags, "cert")
+		}
+		if config.KeyFile == "" {
+			missingFlags = append(missingFlags, "key")
+		}
+	}
+
+	if len(missingFlags) > 0 {
+		return nil, missingFlags
+	}
+
+	if err := validateConfig(config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// validateConfig checks optional settings once all sources have been merged.
+func validateConfig(config *Config) error {
+	if config.ListenSocket == "" {
+		if err := validateListenHosts(config.Host); err != nil {
+			return err
+		}
+	}
+
+	if config.ProxySocket != "" && (config.ProxyHost != "" || config.ProxyPort != 0) {
+		return fmt.Errorf("--proxy-for-socket cannot be combined with --proxy-for-host or --proxy-for-port")
+	}
+
+	if err := validateListenSocket(config); err != nil {
+		return err
+	}
+
+	if config.AltSvc != "" && !validAltSvc(config.AltSvc) {
+		return fmt.Errorf("invalid --alt-svc %q, expected \"clear\" or entries like h3=\":443\"; ma=86400", config.AltSvc)
+	}
+
+	if config.HTTP3 && (config.NoTLS || config.ListenSocket != "") {
+		return fmt.Errorf("--http3 needs TLS on --host and --port and cannot be used with --no-tls or --listen-socket")
+	}
+
+	// Redirects and Alt-Svc name the port, which isn't known up front
+	if config.ListenSocket == "" && config.Port == 0 &&
+		(config.HTTP3 || config.HTTPRedirectPort != 0 || len(config.ACMEDomains) > 0) {
+		return fmt.Errorf("--port 0 cannot be combined with --http3, --http-redirect-port or --acme-domains")
+	}
+	if config.Port < 0 || config.Port > 65535 {
+		return fmt.Errorf("--port must be between 0 and 65535")
+	}
+
+	if config.NoTLS {
+		if config.CertFile != "" || config.KeyFile != "" || len(config.ACMEDomains) > 0 {
+			return fmt.Errorf("--no-tls cannot be combined with --cert, --key or --acme-domains")
+		}
+		if config.HTTPRedirectPort != 0 || config.ClientCAFile != "" {
+			return fmt.Errorf("--http-redirect-port and --client-ca need TLS and cannot be used with --no-tls")
+		}
+	}
+
+	if config.SelfSigned {
+		if config.CertFile != "" || config.KeyFile != "" || len(config.ACMEDomains) > 0 || config.NoTLS {
+			return fmt.Errorf("--self-signed cannot be combined with --cert, --key, --acme-domains or --no-tls")
+		}
+	} else if len(config.SelfSignedHosts) > 0 {
+		return fmt.Errorf("--self-signed-hosts requires --self-signed")
+	}
+
+	endpoints := map[string]string{}
+	for _, endpoint := range []struct{ flag, path string }{
+		{"health-path", config.HealthPath},
+		{"ready-path", config.ReadyPath},
+		{"metrics-path", config.MetricsPath},
+		{"status-path", config.StatusPath},
+		{"version-path", config.VersionPath},
+		{"admin-path", config.AdminPath},
+	} {
+		if endpoint.path == "" {
+			continue
+		}
+		if !strings.HasPrefix(endpoint.path, "/") {
+			return fmt.Errorf("--%s must start with /", endpoint.flag)
+		}
+		// The paths become ServeMux patterns, where / and a trailing slash
+		// match whole subtrees and braces are wildcards. The admin API's
+		// trailing slash is dropped, but / would still put it at the root.
+		if normalizePrefix(endpoint.path) == "" {
+			return fmt.Errorf("--%s cannot be /", endpoint.flag)
+		}
+		if endpoint.flag != "admin-path" && strings.HasSuffix(endpoint.path, "/") {
+			return fmt.Errorf("--%s cannot end with /", endpoint.flag)
+		}
+		if strings.ContainsAny(endpoint.path, "{} \t") {
+			return fmt.Errorf("--%s cannot contain braces or whitespace", endpoint.flag)
+		}
+		if other, ok := endpoints[endpoint.path]; ok {
+			return fmt.Errorf("--%s and --%s cannot both be %s", other, endpoint.flag, endpoint.path)
+		}
+		endpoints[endpoint.path] = endpoint.flag
+	}
+
+	if config.AdminPath != "" && config.AdminToken == "" {
+		return fmt.Errorf("--admin-path requires --admin-token")
+	}
+	if config.MaintenanceFailReady && config.ReadyPath == "" {
+		return fmt.Errorf("--maintenance-fail-ready requires --ready-path")
+	}
+
+	if config.ReadyTimeout <= 0 {
+		return fmt.Errorf("--ready-timeout must be positive")
+	}
+	if config.StartupWait > 0 && config.ReadyPath == "" {
+		return fmt.Errorf("--startup-wait requires --ready-path")
+	}
+
+	for _, timeout := range []struct {
+		flag  string
+		value time.Duration
+	}{
+		{"read-timeout", config.ReadTimeout},
+		{"read-header-timeout", config.ReadHeaderTimeout},
+		{"write-timeout", config.WriteTimeout},
+		{"idle-timeout", config.IdleTimeout},
+		{"upstream-timeout", config.UpstreamTimeout},
+		{"upstream-idle-conn-timeout", config.UpstreamIdleConnTimeout},
+		{"upstream-tcp-keepalive", config.UpstreamTCPKeepAlive},
+		{"dns-cache-ttl", config.DNSCacheTTL},
+		{"startup-wait", config.StartupWait},
+		{"maintenance-retry-after", config.MaintenanceRetryAfter},
+	} {
+		if timeout.value < 0 {
+			return fmt.Errorf("--%s cannot be negative", timeout.flag)
+		}
+	}
+
+	if config.ShutdownTimeout <= 0 {
+		return fmt.Errorf("--shutdown-timeout must be positive")
+	}
+
+	if config.PprofAddr != "" {
+		if _, _, err := net.SplitHostPort(config.PprofAddr); err != nil {
+			return fmt.Errorf("--pprof-addr must be host:port, got %q", config.PprofAddr)
+		}
+	}
+	if config.HTTPRedirectPort < 0 || config.HTTPRedirectPort > 65535 {
+		return fmt.Errorf("--http-redirect-port must be between 0 and 65535 (0 disables it)")
+	}
+	if config.HTTPRedirectPort != 0 && config.HTTPRedirectPort == config.Port {
+		return fmt.Errorf("--http-redirect-port cannot be the same as --port")
+	}
+
+	if config.CertReloadInterval < 0 {
+		return fmt.Errorf("--cert-reload-interval cannot be negative")
+	}
+	if config.CertExpiryWarning < 0 || config.CertExpiryInterval < 0 {
+		return fmt.Errorf("--cert-expiry-warning and --cert-expiry-check-interval cannot be negative")
+	}
+
+	if len(config.ACMEDomains) > 0 {
+		if config.CertFile != "" || config.KeyFile != "" {
+			return fmt.Errorf("--acme-domains cannot be combined with --cert or --key")
+		}
+		if config.ACMECacheDir == "" {
+			return fmt.Errorf("--acme-cache-dir is required with --acme-domains")
+		}
+		if err := validateACMEDomains(config.ACMEDomains); err != nil {
+			return err
+		}
+	}
+
+	if config.CanaryBackend != "" {
+		if _, err := newBackendPool(config.CanaryBackend, config.ProxyPort, backendScheme(config)); err != nil {
+			return fmt.Errorf("--canary-backend: %v", err)
+		}
+	} else if config.CanaryPercent != 0 || config.CanaryCookie != "" {
+		return fmt.Errorf("--canary-percent and --canary-cookie require --canary-backend")
+	}
+	if config.CanaryPercent < 0 || config.CanaryPercent > 100 {
+		return fmt.Errorf("--canary-percent must be between 0 and 100")
+	}
+	if config.MirrorBackend != "" {
+		if _, err := newBackendPool(config.MirrorBackend, config.ProxyPort, backendScheme(config)); err != nil {
+			return fmt.Errorf("--mirror-backend: %v", err)
+		}
+	}
+	if config.MirrorPercent <= 0 || config.MirrorPercent > 100 {
+		return fmt.Errorf("--mirror-percent must be above 0 and at most 100")
+	}
+	if config.PreserveHeaderCase && (config.BackendTLS || config.BackendHTTP2) {
+		return fmt.Errorf("--preserve-header-case reads the backend's HTTP/1.1 responses and cannot be combined with --backend-tls or --backend-http2")
+	}
+	if config.BackendTLS {
+		if config.BackendHTTP2 {
+			return fmt.Errorf("--backend-http2 is cleartext HTTP/2 and cannot be combined with --backend-tls, which negotiates HTTP/2 with backends that support it")
+		}
+		if config.ProxySocket != "" {
+			return fmt.Errorf("--backend-tls cannot be used with --proxy-for-socket")
+		}
+		if config.BackendInsecureSkipVerify && config.BackendCAFile != "" {
+			return fmt.Errorf("--backend-insecure-skip-verify and --backend-ca cannot be combined")
+		}
+	} else if config.BackendInsecureSkipVerify || config.BackendCAFile != "" || config.BackendServerName != "" {
+		return fmt.Errorf("--backend-insecure-skip-verify, --backend-ca and --backend-server-name require --backend-tls")
+	}
+	if config.BackendLocalAddr != "" && net.ParseIP(config.BackendLocalAddr) == nil {
+		return fmt.Errorf("invalid --backend-local-addr %q, expected an IP address of this host", config.BackendLocalAddr)
+	}
+
+	if err := validateRoutes(config.Routes); err != nil {
+		return err
+	}
+	if err := validateDomains(config); err != nil {
+		return err
+	}
+	if config.StripPrefix != "" && !strings.HasPrefix(config.StripPrefix, "/") {
+		return fmt.Errorf("--strip-prefix must start with /")
+	}
+	for _, header := range []struct {
+		flag string
+		name string
+	}{
+		{"forwarded-host-header", config.ForwardedHostHeader},
+		{"forwarded-proto-header", config.ForwardedProtoHeader},
+		{"real-ip-header", config.RealIPHeader},
+	} {
+		if header.name != "" && !httpguts.ValidHeaderFieldName(header.name) {
+			return fmt.Errorf("--%s must be a valid header name, got %q", header.flag, header.name)
+		}
+		if http.CanonicalHeaderKey(header.name) == "X-Forwarded-For" {
+			return fmt.Errorf("--%s cannot be X-Forwarded-For, which the relay always manages", header.flag)
+		}
+	}
+	if strings.ContainsAny(config.PublicHost, "/ ") {
+		return fmt.Errorf("--public-host must be a host name with an optional port, got %q", config.PublicHost)
+	}
+	if config.MountPath != "" && (!strings.HasPrefix(config.MountPath, "/") || config.MountPath == "/") {
+		return fmt.Errorf("--mount-path must start with / and name a path below the root")
+	}
+
+	if _, err := newHeaderRules(config.AddRequestHeaders, config.RemoveRequestHeaders); err != nil {
+		return err
+	}
+	if _, err := newHeaderRules(config.AddResponseHeaders, config.RemoveResponseHeaders); err != nil {
+		return err
+	}
+
+	if _, err := newBodyRewriter(config.RewriteBody, config.MaxBufferedBody); err != nil {
+		return err
+	}
+
+	if config.HSTSMaxAge < 0 {
+		return fmt.Errorf("--hsts-max-age cannot be negative")
+	}
+
+	if config.AccessLogMaxSize <= 0 {
+		return fmt.Errorf("--access-log-max-size must be positive")
+	}
+	if config.AccessLogMaxBackups < 0 {
+		return fmt.Errorf("--access-log-max-backups cannot be negative")
+	}
+	if config.LogFile != "" && config.LogFile == config.AccessLogFile {
+		return fmt.Errorf("--log-file and --access-log-file must be different files")
+	}
+
+	if config.BufferSize < 0 {
+		return fmt.Errorf("--buffer-size cannot be negative")
+	}
+
+	if config.CompressMinSize < 0 {
+		return fmt.Errorf("--compress-min-size cannot be negative")
+	}
+
+	if config.CacheTTL < 0 {
+		return fmt.Errorf("--cache-ttl cannot be negative")
+	}
+	if config.CacheTTL > 0 && config.CacheMaxSize <= 0 {
+		return fmt.Errorf("--cache-max-size must be positive when caching is enabled")
+	}
+
+	for _, ext := range config.StaticExtensions {
+		if !strings.HasPrefix(ext, ".") || len(ext) < 2 {
+			return fmt.Errorf("invalid static extension %q, expected a form like .js", ext)
+		}
+	}
+
+	if config.UpstreamMaxIdleConns < 0 || config.UpstreamMaxIdleConnsPerHost < 0 {
+		return fmt.Errorf("--upstream-max-idle-conns and --upstream-max-idle-conns-per-host cannot be negative")
+	}
+
+	if config.MaxConnections < 0 {
+		return fmt.Errorf("--max-connections cannot be negative")
+	}
+	if config.ConnectionMaxLifetime < 0 {
+		return fmt.Errorf("--connection-max-lifetime cannot be negative")
+	}
+
+	if config.RateLimit < 0 || config.RateBurst < 0 {
+		return fmt.Errorf("--rate-limit and --rate-burst cannot be negative")
+	}
+
+	if _, err := newIPFilter(config.AllowCIDRs, config.DenyCIDRs); err != nil {
+		return err
+	}
+	if _, err := newTrustedProxies(config.TrustedProxies); err != nil {
+		return fmt.Errorf("--trusted-proxies: %v", err)
+	}
+
+	if config.MaxRequestBody < 0 {
+		return fmt.Errorf("--max-request-body cannot be negative")
+	}
+	if config.MaxHeaderBytes <= 0 {
+		return fmt.Errorf("--max-header-bytes must be positive")
+	}
+	if config.MaxBufferedBody <= 0 {
+		return fmt.Errorf("--max-buffered-body must be positive")
+	}
+	if _, err := newStatusRemap(config.RemapStatus); err != nil {
+		return fmt.Errorf("--remap-status: %v", err)
+	}
+
+	if !pathNormalizations[config.PathNormalization] {
+		return fmt.Errorf("--path-normalization must be strict, clean or off, got %q", config.PathNormalization)
+	}
+	if !trailingSlashModes[config.TrailingSlash] {
+		return fmt.Errorf("--trailing-slash must be add, remove or off, got %q", config.TrailingSlash)
+	}
+	if len(config.TrailingSlashPaths) > 0 && config.TrailingSlash == "off" {
+		return fmt.Errorf("--trailing-slash-paths requires --trailing-slash add or remove")
+	}
+	for _, prefix := range config.TrailingSlashPaths {
+		if !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("--trailing-slash-paths entry %q must start with /", prefix)
+		}
+	}
+	if _, err := newMethodFilter(config.AllowMethods); err != nil {
+		return fmt.Errorf("--allow-methods: %v", err)
+	}
+
+	if config.RetryAttempts < 0 || config.RetryBackoff < 0 {
+		return fmt.Errorf("--retry-attempts and --retry-backoff cannot be negative")
+	}
+
+	if config.CircuitFailureThreshold < 0 {
+		return fmt.Errorf("--circuit-failure-threshold cannot be negative")
+	}
+	if config.CircuitFailureThreshold > 0 && config.CircuitResetTimeout <= 0 {
+		return fmt.Errorf("--circuit-reset-timeout must be positive when the circuit breaker is enabled")
+	}
+
+	if config.StickySessions {
+		if err := (&http.Cookie{Name: config.StickyCookieName, Value: "x"}).Valid(); err != nil {
+			return fmt.Errorf("--sticky-cookie-name %q is not a valid cookie name", config.StickyCookieName)
+		}
+		if config.StickyCookieTTL < 0 {
+			return fmt.Errorf("--sticky-cookie-ttl cannot be negative")
+		}
+	}
+	if config.HealthCheckInterval < 0 {
+		return fmt.Errorf("--health-check-interval cannot be negative")
+	}
+	if config.HealthCheckInterval > 0 {
+		if config.HealthCheckTimeout <= 0 {
+			return fmt.Errorf("--health-check-timeout must be positive")
+		}
+		if config.HealthCheckRise < 1 || config.HealthCheckFall < 1 {
+			return fmt.Errorf("--health-check-rise and --health-check-fall must be at least 1")
+		}
+		if config.HealthCheckPath != "" && !strings.HasPrefix(config.HealthCheckPath, "/") {
+			return fmt.Errorf("--health-check-path must start with /")
+		}
+	}
+
+	if _, err := newCORSPolicy(config.CORSAllowedOrigins, config.CORSAllowedMethods, config.CORSAllowedHeaders); err != nil {
+		return err
+	}
+
+	if config.BasicAuthUser == "" && config.BasicAuthPass != "" {
+		return fmt.Errorf("--basic-auth-pass requires --basic-auth-user")
+	}
+	if config.BasicAuthUser != "" && config.BasicAuthPass == "" {
+		return fmt.Errorf("--basic-auth-user requires --basic-auth-pass")
+	}
+
+	if _, ok := tlsVersions[config.MinTLSVersion]; !ok {
+		return fmt.Errorf("--min-tls-version must be 1.2 or 1.3, got %q", config.MinTLSVersion)
+	}
+	if _, err := parseCipherSuites(config.CipherSuites); err != nil {
+		return err
+	}
+
+	if config.OTLPEndpoint != "" {
+		if err := validateOTLPEndpoint(config.OTLPEndpoint); err != nil {
+			return err
+		}
+	}
+
+	if config.LogFormat != "text" && config.LogFormat != "json" {
+		return fmt.Errorf("--log-format must be text or json, got %q", config.LogFormat)
+	}
+	if _, ok := logLevels[config.LogLevel]; !ok {
+		return fmt.Errorf("--log-level must be debug, info, warn or error, got %q", config.LogLevel)
+	}
+
+	return nil
+}
+
+// validateListenSocket checks the settings that conflict with or depend on
+// serving on a Unix socket.
+func validateListenSocket(config *Config) error {
+	if config.ListenSocket == "" {
+		return nil
+	}
+	if _, err := parseFileMode(config.ListenSocketMode); err != nil {
+		return fmt.Errorf("--listen-socket-mode: %v", err)
+	}
+	if config.Host != "" || config.Port != 0 {
+		return fmt.Errorf("--listen-socket cannot be combined with --host or --port")
+	}
+	if (config.CertFile == "") != (config.KeyFile == "") {
+		return fmt.Errorf("--cert and --key must be set together")
+	}
+	if len(config.ACMEDomains) > 0 || config.HTTPRedirectPort != 0 {
+		return fmt.Errorf("--acme-domains and --http-redirect-port need a TCP listener and cannot be used with --listen-socket")
+	}
+	if config.ClientCAFile != "" && config.CertFile == "" {
+		return fmt.Errorf("--client-ca requires --cert and --key")
+	}
+	return nil
+}
+
+// listValue is a flag.Value for comma-separated lists that may also be
+// repeated. The first value given replaces any list loaded from the config
+// file instead of extending it.
+type listValue struct {
+	list *[]string
+	set  bool
+}
+
+func (v *listValue) String() string {
+	if v.list == nil {
+		return ""
+	}
+	return strings.Join(*v.list, ",")
+}
+
+func (v *listValue) Set(value string) error {
+	if !v.set {
+		*v.list = nil
+		v.set = true
+	}
+	*v.list = append(*v.list, splitList(value)...)
+	return nil
+}
+
+// repeatedValue is a flag.Value collecting every occurrence of a repeatable
+// flag without splitting on commas, for values that may contain them. Like
+// listValue, the first occurrence replaces any list from the config file.
+type repeatedValue struct {
+	list *[]string
+	set  bool
+}
+
+func (v *repeatedValue) String() string {
+	if v.list == nil {
+		return ""
+	}
+	return strings.Join(*v.list, "; ")
+}
+
+func (v *repeatedValue) Set(value string) error {
+	if !v.set {
+		*v.list = nil
+		v.set = true
+	}
+	*v.list = append(*v.list, value)
+	return nil
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// envVars maps environment variables onto the flags they provide a fallback
+// for.
+var envVars = []struct {
+	name string
+	flag string
+}{
+	{"JNBRELAY_HOST", "host"},
+	{"JNBRELAY_PORT", "port"},
+	{"JNBRELAY_PROXY_HOST", "proxy-for-host"},
+	{"JNBRELAY_PROXY_PORT", "proxy-for-port"},
+	{"JNBRELAY_CERT", "cert"},
+	{"JNBRELAY_KEY", "key"},
+	{"JNBRELAY_BASIC_AUTH_USER", "basic-auth-user"},
+	{"JNBRELAY_BASIC_AUTH_PASS", "basic-auth-pass"},
+	{"JNBRELAY_STATUS_TOKEN", "status-token"},
+	{"JNBRELAY_ADMIN_TOKEN", "admin-token"},
+}
+
+// applyEnv sets flags on fs from any environment variables that are present.
+func applyEnv(fs *flag.FlagSet) error {
+	for _, env := range envVars {
+		value, ok := os.LookupEnv(env.name)
+		if !ok || value == "" {
+			continue
+		}
+		if err := fs.Set(env.flag, value); err != nil {
+			return fmt.Errorf("invalid value %q for environment variable %s: %v", value, env.name, err)
+		}
+	}
+	return nil
+}
+
+// loadConfigFile reads a YAML or JSON config file. YAML is a superset of
+// JSON, so a single decoder handles both formats.
+func loadConfigFile(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read config file: %v", err)
+	}
+
+	config := defaultConfig()
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("malformed config file %s: %v", path, err)
+	}
+
+	return config, nil
+}
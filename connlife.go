@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+// connStartContext is the request context key for the time the client
+// connection was accepted.
+type connStartContext struct{}
+
+// markConnStart is an http.Server ConnContext hook that records when each
+// connection was accepted.
+func markConnStart(ctx context.Context, _ net.Conn) context.Context {
+	return context.WithValue(ctx, connStartContext{}, time.Now())
+}
+
+// limitConnLifetime closes client connections older than maxLifetime once
+// the current request is done, by answering it with Connection: close. Over
+// HTTP/2 that makes the server send GOAWAY, so streams already open still
+// finish. Clients then reconnect, which spreads them across relays again
+// after a DNS-based load balancer has gained instances.
+func limitConnLifetime(maxLifetime time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if started, ok := r.Context().Value(connStartContext{}).(time.Time); ok && time.Since(started) >= maxLifetime {
+			w.Header().Set("Connection", "close")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// connLimiter caps the number of client connections open at once across
+// all listeners. Once the limit is reached, Accept waits until a
+// connection closes.
+type connLimiter struct {
+	slots   chan struct{}
+	lastLog atomic.Int64
+}
+
+func newConnLimiter(max int) *connLimiter {
+	return &connLimiter{slots: make(chan struct{}, max)}
+}
+
+// wrap returns l limited by the shared connection count.
+func (c *connLimiter) wrap(l net.Listener) net.Listener {
+	return &limitListener{Listener: l, limiter: c, done: make(chan struct{})}
+}
+
+// acquire takes a slot, waiting if none is free. It reports false if done
+// is closed first.
+func (c *connLimiter) acquire(done <-chan struct{}, name string) bool {
+	select {
+	case c.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	// Log at most every 10 seconds while the limit is being hit
+	now := time.Now().UnixNano()
+	if last := c.lastLog.Load(); now-last > int64(10*time.Second) && c.lastLog.CompareAndSwap(last, now) {
+		warnf("Connection limit of %d reached, new connections on %s are waiting", cap(c.slots), name)
+	}
+
+	select {
+	case c.slots <- struct{}{}:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+func (c *connLimiter) release() {
+	<-c.slots
+}
+
+type limitListener struct {
+	net.Listener
+	limiter   *connLimiter
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	if !l.limiter.acquire(l.done, listenerName(l.Listener)) {
+		return nil, net.ErrClosed
+	}
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		l.limiter.release()
+		return nil, err
+	}
+	return &limitConn{Conn: conn, release: sync.OnceFunc(l.limiter.release)}, nil
+}
+
+func (l *limitListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// limitConn gives its slot back when closed.
+type limitConn struct {
+	net.Conn
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.release()
+	return err
+}
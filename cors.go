@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// corsPolicy adds CORS headers for allowed origins and answers preflight
+// requests itself, so they never reach the backend.
+type corsPolicy struct {
+	anyOrigin bool
+	origins   map[string]bool
+	methods   string
+	headers   string
+}
+
+func newCORSPolicy(origins, methods, headers []string) (*corsPolicy, error) {
+	p := &corsPolicy{
+		origins: map[string]bool{},
+		methods: strings.Join(methods, ", "),
+		headers: strings.Join(headers, ", "),
+	}
+	for _, origin := range origins {
+		if origin == "*" {
+			p.anyOrigin = true
+			continue
+		}
+		if !strings.Contains(origin, "://") {
+			return nil, fmt.Errorf("invalid CORS origin %q, expected * or a form like https://app.example.com", origin)
+		}
+		p.origins[strings.ToLower(strings.TrimSuffix(origin, "/"))] = true
+	}
+	return p, nil
+}
+
+func (p *corsPolicy) allows(origin string) bool {
+	return p.anyOrigin || p.origins[strings.ToLower(origin)]
+}
+
+func (p *corsPolicy) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		allowed := p.allows(origin)
+		if allowed {
+			if p.anyOrigin {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			} else {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Add("Vary", "Origin")
+			}
+		}
+
+		// Preflights are answered here; a disallowed origin gets no CORS
+		// headers, which the browser treats as a refusal
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			if allowed {
+				w.Header().Set("Access-Control-Allow-Methods", p.methods)
+				if p.headers != "" {
+					w.Header().Set("Access-Control-Allow-Headers", p.headers)
+				}
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
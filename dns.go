@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// dnsCache resolves backend host names at most once per ttl instead of on
+// every dial. Dials rotate through every address a name resolves to, and a
+// failed dial drops the name so the next one resolves it again.
+type dnsCache struct {
+	ttl      time.Duration
+	resolver *net.Resolver
+
+	mu      sync.Mutex
+	entries map[string]*dnsEntry
+}
+
+type dnsEntry struct {
+	addrs   []string
+	expires time.Time
+	next    atomic.Uint64
+}
+
+func newDNSCache(ttl time.Duration) *dnsCache {
+	return &dnsCache{ttl: ttl, resolver: net.DefaultResolver, entries: map[string]*dnsEntry{}}
+}
+
+// lookup returns the addresses of host, resolving it if the cached entry is
+// missing or expired. If resolving fails, an expired entry is used rather
+// than failing the request.
+func (c *dnsCache) lookup(ctx context.Context, host string) (*dnsEntry, error) {
+	c.mu.Lock()
+	entry := c.entries[host]
+	c.mu.Unlock()
+	if entry != nil && time.Now().Before(entry.expires) {
+		return entry, nil
+	}
+
+	addrs, err := c.resolver.LookupHost(ctx, host)
+	if err != nil {
+		if entry != nil {
+			warnf("Resolving %s failed, using the expired addresses: %v", host, err)
+			return entry, nil
+		}
+		return nil, err
+	}
+	fresh := &dnsEntry{addrs: addrs, expires: time.Now().Add(c.ttl)}
+	c.mu.Lock()
+	c.entries[host] = fresh
+	c.mu.Unlock()
+	return fresh, nil
+}
+
+// invalidate forgets host, so the next dial resolves it again.
+func (c *dnsCache) invalidate(host string) {
+	c.mu.Lock()
+	delete(c.entries, host)
+	c.mu.Unlock()
+}
+
+// dialContext wraps dial to connect to cached addresses. Each dial starts at
+// the next address in turn and falls back to the others if it fails.
+// Addresses that are already IPs are dialed as they are.
+func (c *dnsCache) dialContext(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil {
+			return dial(ctx, network, addr)
+		}
+		entry, err := c.lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+
+		start := entry.next.Add(1) - 1
+		var errs []error
+		for i := range entry.addrs {
+			ip := entry.addrs[(start+uint64(i))%uint64(len(entry.addrs))]
+			conn, err := dial(ctx, network, net.JoinHostPort(ip, port))
+			if err == nil {
+				return conn, nil
+			}
+			errs = append(errs, err)
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		c.invalidate(host)
+		return nil, errors.Join(errs...)
+	}
+}
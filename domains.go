@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DomainConfig gives a domain its own certificate and backends. Backend uses
+// the same syntax as --proxy-for-host. Leaving out the certificate serves the
+// default one, and leaving out the backend uses the default routes. A domain
+// named "*.example.com" covers every subdomain of example.com that has no
+// entry of its own.
+type DomainConfig struct {
+	Cert    string `yaml:"cert"`
+	Key     string `yaml:"key"`
+	Backend string `yaml:"backend"`
+}
+
+// domainRouter serves each configured domain with its certificate, chosen
+// by SNI, and its backends, chosen by the Host header.
+type domainRouter struct {
+	names  map[string]bool
+	certs  map[string]*certReloader
+	routes map[string]*route
+}
+
+func newDomainRouter(domains map[string]DomainConfig, defaultPort int, scheme, stripPrefix string, strict bool) (*domainRouter, error) {
+	d := &domainRouter{names: map[string]bool{}, certs: map[string]*certReloader{}, routes: map[string]*route{}}
+	for name, dc := range domains {
+		name = strings.ToLower(name)
+		d.names[name] = true
+		if dc.Cert != "" {
+			certs, err := newCertReloader(dc.Cert, dc.Key, strict)
+			if err != nil {
+				return nil, fmt.Errorf("domain %s: %v", name, err)
+			}
+			d.certs[name] = certs
+		}
+		if dc.Backend != "" {
+			pool, err := newBackendPool(dc.Backend, defaultPort, scheme)
+			if err != nil {
+				return nil, fmt.Errorf("domain %s: %v", name, err)
+			}
+			d.routes[name] = &route{pool: pool, stripPrefix: normalizePrefix(stripPrefix)}
+		}
+	}
+	return d, nil
+}
+
+// getCertificate returns a tls.Config.GetCertificate that picks the
+// certificate of the domain the client asked for, and leaves clients that
+// ask for any other name, or send no SNI, to fallback.
+func (d *domainRouter) getCertificate(fallback func(*tls.ClientHelloInfo) (*tls.Certificate, error)) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if len(d.certs) == 0 {
+		return fallback
+	}
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if certs, ok := d.certs[d.lookup(hello.ServerName)]; ok {
+			return certs.GetCertificate(hello)
+		}
+		return fallback(hello)
+	}
+}
+
+// reloaders returns the domain certificates.
+func (d *domainRouter) reloaders() []*certReloader {
+	var reloaders []*certReloader
+	for _, certs := range d.certs {
+		reloaders = append(reloaders, certs)
+	}
+	return reloaders
+}
+
+// watch reloads the domain certificates as their files change.
+func (d *domainRouter) watch(interval time.Duration) {
+	for _, certs := range d.certs {
+		go certs.watch(interval)
+	}
+}
+
+// lookup returns the configured domain that covers host: the host itself,
+// or else the closest wildcard above it, so "*.eu.example.com" wins over
+// "*.example.com" for "a.eu.example.com". It returns "" for unknown hosts.
+func (d *domainRouter) lookup(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if d.names[host] {
+		return host
+	}
+	for {
+		i := strings.IndexByte(host, '.')
+		if i < 0 {
+			return ""
+		}
+		host = host[i+1:]
+		if d.names["*."+host] {
+			return "*." + host
+		}
+	}
+}
+
+// match returns the route for a request's Host header, or nil when the
+// domain has no backends of its own.
+func (d *domainRouter) match(host string) *route {
+	if len(d.routes) == 0 {
+		return nil
+	}
+	return d.routes[d.lookup(host)]
+}
+
+// rejectUnknown answers requests for hosts that no domain covers with 404
+// instead of passing them to the default backends.
+func (d *domainRouter) rejectUnknown(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if d.lookup(r.Host) == "" {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// pools returns the backends of every domain, for health checking.
+func (d *domainRouter) pools() []*backendPool {
+	var pools []*backendPool
+	for _, rt := range d.routes {
+		pools = append(pools, rt.pool)
+	}
+	return pools
+}
+
+// logDomains lists the domains served with their own backends.
+func (d *domainRouter) logDomains() {
+	names := make([]string, 0, len(d.routes))
+	for name := range d.routes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		infof("Routing host %s -> %s", name, d.routes[name].pool)
+	}
+}
+
+// validateDomains checks the domain table from the config file. Domain
+// certificates are only selected over TLS, so they need a default
+// certificate for clients that ask for another name.
+func validateDomains(config *Config) error {
+	if config.RejectUnknownHosts && len(config.Domains) == 0 {
+		return fmt.Errorf("--reject-unknown-hosts requires domains in the config file")
+	}
+	hasDefaultCert := config.CertFile != "" || len(config.ACMEDomains) > 0 || config.SelfSigned
+	for name, dc := range config.Domains {
+		if name == "" || strings.ContainsAny(strings.TrimPrefix(name, "*."), ":/* ") {
+			return fmt.Errorf("invalid domain %q, expected a host name without port, or *. followed by one", name)
+		}
+		if dc.Cert == "" && dc.Key == "" && strings.TrimSpace(dc.Backend) == "" {
+			return fmt.Errorf("domain %s needs a cert and key, a backend, or both", name)
+		}
+		if (dc.Cert == "") != (dc.Key == "") {
+			return fmt.Errorf("domain %s: cert and key must be set together", name)
+		}
+		if dc.Cert != "" && !hasDefaultCert {
+			return fmt.Errorf("domain %s: domain certificates need a default --cert, --acme-domains or --self-signed certificate", name)
+		}
+	}
+	return nil
+}
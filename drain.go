@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// activeRequests tracks the requests being served so shutdown can report on
+// the drain. total counts every request since startup.
+type activeRequests struct {
+	count  atomic.Int64
+	total  atomic.Uint64
+	nextID atomic.Uint64
+	paths  sync.Map
+}
+
+func (a *activeRequests) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := a.nextID.Add(1)
+		a.paths.Store(id, r.Method+" "+r.URL.Path)
+		a.count.Add(1)
+		a.total.Add(1)
+		defer func() {
+			a.count.Add(-1)
+			a.paths.Delete(id)
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// reportDrain logs how many requests are still in flight every interval
+// until there are none left or ctx is done.
+func (a *activeRequests) reportDrain(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		n := a.count.Load()
+		if n == 0 {
+			return
+		}
+		infof("Waiting for %d active requests to finish", n)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// logRemaining logs the requests that are still active, such as when the
+// shutdown deadline passes before they finish.
+func (a *activeRequests) logRemaining() {
+	n := a.count.Load()
+	if n == 0 {
+		return
+	}
+	warnf("%d requests still active at shutdown:", n)
+	a.paths.Range(func(_, path any) bool {
+		warnf("  %s", path)
+		return true
+	})
+}
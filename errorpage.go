@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// defaultErrorPage is served when --error-page is not set.
+const defaultErrorPage = `<!DOCTYPE html>
+<html>
+<head><title>{{.Status}} {{.StatusText}}</title></head>
+<body>
+<h1>{{.Status}} {{.StatusText}}</h1>
+<p>The relay could not get a response from the backend. Please try again later.</p>
+<p><small>Request ID: {{.RequestID}}</small></p>
+</body>
+</html>
+`
+
+// errorPage writes the response for requests the proxy could not complete:
+// a JSON object for clients that ask for JSON, and an HTML page otherwise.
+type errorPage struct {
+	html *template.Template
+}
+
+// errorPageData is what an --error-page template can refer to.
+type errorPageData struct {
+	Status     int
+	StatusText string
+	RequestID  string
+}
+
+// newErrorPage parses the HTML template in path, or the default page if
+// path is empty.
+func newErrorPage(path string) (*errorPage, error) {
+	return loadErrorPage("error page", path, defaultErrorPage)
+}
+
+// loadErrorPage parses the HTML template in path, or fallback if path is
+// empty. name describes the page in errors.
+func loadErrorPage(name, path, fallback string) (*errorPage, error) {
+	source := fallback
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read %s: %v", name, err)
+		}
+		source = string(b)
+	}
+	tmpl, err := template.New(name).Parse(source)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse %s %s: %v", name, path, err)
+	}
+	return &errorPage{html: tmpl}, nil
+}
+
+func (p *errorPage) write(w http.ResponseWriter, r *http.Request, status int) {
+	if isGRPC(r.Header.Get("Content-Type")) {
+		writeGRPCError(w, status)
+		return
+	}
+
+	data := errorPageData{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		RequestID:  r.Header.Get(requestIDHeader),
+	}
+
+	var body bytes.Buffer
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(&body).Encode(map[string]any{
+			"error":      data.StatusText,
+			"status":     data.Status,
+			"request_id": data.RequestID,
+		})
+	} else {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := p.html.Execute(&body, data); err != nil {
+			errorf("Error page template failed: %v", err)
+			body.Reset()
+			body.WriteString(data.StatusText + "\n")
+		}
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Length", strconv.Itoa(body.Len()))
+	w.WriteHeader(status)
+	w.Write(body.Bytes())
+}
+
+// wantsJSON reports whether the client prefers JSON over HTML.
+func wantsJSON(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html")
+}
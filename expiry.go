@@ -0,0 +1,44 @@
+package main
+
+import (
+	"time"
+)
+
+// certExpiryMonitor periodically checks the certificates loaded from disk and
+// warns once one is within threshold of expiring, so a failed renewal is
+// noticed before clients start getting errors.
+type certExpiryMonitor struct {
+	certs     []*certReloader
+	threshold time.Duration
+	interval  time.Duration
+	metrics   *relayMetrics
+}
+
+// run checks the certificates right away and then every interval.
+func (m *certExpiryMonitor) run() {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		m.check(time.Now())
+		<-ticker.C
+	}
+}
+
+func (m *certExpiryMonitor) check(now time.Time) {
+	for _, r := range m.certs {
+		cert, _ := r.GetCertificate(nil)
+		notAfter := cert.Leaf.NotAfter
+		remaining := notAfter.Sub(now)
+		if m.metrics != nil {
+			m.metrics.setCertExpiry(r.certFile, remaining)
+		}
+
+		switch {
+		case remaining <= 0:
+			errorf("Certificate %s expired on %s", r.certFile, notAfter.Format(time.RFC3339))
+		case remaining < m.threshold:
+			warnf("Certificate %s expires in %d days, on %s", r.certFile, int(remaining.Hours()/24), notAfter.Format(time.RFC3339))
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// gRPC status codes the relay answers with when it cannot reach the backend.
+const (
+	grpcUnknown          = 2
+	grpcPermissionDenied = 7
+	grpcUnimplemented    = 12
+	grpcInternal         = 13
+	grpcUnavailable      = 14
+	grpcUnauthenticated  = 16
+)
+
+// isGRPC reports whether contentType is a gRPC payload, such as
+// application/grpc or application/grpc+proto.
+func isGRPC(contentType string) bool {
+	mt := mediaType(contentType)
+	return mt == "application/grpc" || strings.HasPrefix(mt, "application/grpc+")
+}
+
+// grpcCode maps an HTTP status onto the gRPC status code clients expect for
+// it, following the mapping in the gRPC HTTP/2 protocol spec.
+func grpcCode(status int) int {
+	switch status {
+	case http.StatusBadRequest:
+		return grpcInternal
+	case http.StatusUnauthorized:
+		return grpcUnauthenticated
+	case http.StatusForbidden:
+		return grpcPermissionDenied
+	case http.StatusNotFound:
+		return grpcUnimplemented
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return grpcUnavailable
+	default:
+		return grpcUnknown
+	}
+}
+
+// writeGRPCError answers a gRPC call the relay could not complete with a
+// trailers-only response, which gRPC clients turn into a status error
+// rather than a protocol error about an unexpected HTML body.
+func writeGRPCError(w http.ResponseWriter, status int) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Status", strconv.Itoa(grpcCode(status)))
+	w.Header().Set("Grpc-Message", http.StatusText(status))
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// grpcFrame wraps msg in the length-prefixed framing gRPC uses on the wire.
+func grpcFrame(msg string) []byte {
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	return append(frame, msg...)
+}
+
+// grpcEchoBackend answers /echo.Echo/Say with the request message and
+// /echo.Echo/Fail with a NOT_FOUND status, over h2c like a gRPC server.
+func grpcEchoBackend() *httptest.Server {
+	return httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		msg, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.WriteHeader(http.StatusOK)
+		if r.URL.Path == "/echo.Echo/Fail" {
+			w.Header().Set(http.TrailerPrefix+"Grpc-Status", "5")
+			w.Header().Set(http.TrailerPrefix+"Grpc-Message", "no such echo")
+			return
+		}
+		w.Write(msg)
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+	}), &http2.Server{}))
+}
+
+// grpcCall sends msg to method through the relay as a gRPC client would and
+// returns the response with its body read, so the trailers are in.
+func grpcCall(t *testing.T, client *http.Client, relayURL, method, msg string) (*http.Response, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, relayURL+method, bytes.NewReader(grpcFrame(msg)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("%s: %v", method, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("%s: reading body: %v", method, err)
+	}
+	return resp, body
+}
+
+// grpcRelay starts the relay over TLS with HTTP/2, as gRPC clients reach it,
+// speaking h2c to the backend at backendURL.
+func grpcRelay(t *testing.T, backendURL string) *httptest.Server {
+	t.Helper()
+	return tlsRelay(t, testConfig(t, append(backendFlags(t, backendURL), "--backend-http2", "--retry-attempts", "0")...))
+}
+
+func TestProxyGRPCTrailers(t *testing.T) {
+	backend := grpcEchoBackend()
+	defer backend.Close()
+	relay := grpcRelay(t, backend.URL)
+	defer relay.Close()
+	client := relay.Client()
+
+	resp, body := grpcCall(t, client, relay.URL, "/echo.Echo/Say", "hello")
+	if resp.ProtoMajor != 2 {
+		t.Errorf("client leg spoke HTTP/%d, want HTTP/2", resp.ProtoMajor)
+	}
+	if !bytes.Equal(body, grpcFrame("hello")) {
+		t.Errorf("Say body = %q, want the echoed frame", body)
+	}
+	if got := resp.Trailer.Get("Grpc-Status"); got != "0" {
+		t.Errorf("Say grpc-status trailer = %q, want 0", got)
+	}
+
+	resp, _ = grpcCall(t, client, relay.URL, "/echo.Echo/Fail", "hello")
+	if got := resp.Trailer.Get("Grpc-Status"); got != "5" {
+		t.Errorf("Fail grpc-status trailer = %q, want 5", got)
+	}
+	if got := resp.Trailer.Get("Grpc-Message"); got != "no such echo" {
+		t.Errorf("Fail grpc-message trailer = %q, want \"no such echo\"", got)
+	}
+}
+
+func TestProxyGRPCBackendDown(t *testing.T) {
+	backend := grpcEchoBackend()
+	backend.Close()
+	relay := grpcRelay(t, backend.URL)
+	defer relay.Close()
+
+	// The relay cannot reach the backend and answers trailers-only, which
+	// puts the status in the response headers
+	resp, body := grpcCall(t, relay.Client(), relay.URL, "/echo.Echo/Say", "hello")
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want 200 as gRPC requires", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Grpc-Status"); got != "14" {
+		t.Errorf("grpc-status = %q, want 14 (Unavailable)", got)
+	}
+	if len(body) != 0 {
+		t.Errorf("body = %q, want none", body)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"sync"
+	"sync/atomic"
+)
+
+// headerCaseContext is the request context key for the backend's original
+// response header names.
+type headerCaseContext struct{}
+
+// framingHeaders are response headers net/http looks up by their canonical
+// name when writing the response, so renaming them would make it add a
+// second copy or frame the body wrongly.
+var framingHeaders = map[string]bool{
+	"Connection":        true,
+	"Content-Length":    true,
+	"Content-Type":      true,
+	"Date":              true,
+	"Keep-Alive":        true,
+	"Trailer":           true,
+	"Transfer-Encoding": true,
+}
+
+// headerCaseConn records the header names of HTTP/1.x responses read from a
+// backend connection exactly as the backend wrote them, before net/http
+// canonicalizes them. The transport does not pipeline, so the bytes that
+// follow a request start the header block of its response.
+type headerCaseConn struct {
+	net.Conn
+
+	mu      sync.Mutex
+	reading bool     // inside a response header block
+	status  bool     // the next line is a status line
+	line    []byte   // the current, incomplete line
+	names   []string // names of the block being read
+	last    []string // names of the last complete block
+}
+
+func (c *headerCaseConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	if !c.reading {
+		c.reading, c.status = true, true
+		c.line, c.names = c.line[:0], nil
+	}
+	c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+func (c *headerCaseConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for rest := b[:n]; c.reading && len(rest) > 0; {
+		i := bytes.IndexByte(rest, '\n')
+		if i < 0 {
+			c.line = append(c.line, rest...)
+			break
+		}
+		c.line = append(c.line, rest[:i]...)
+		rest = rest[i+1:]
+		c.parseLine(bytes.TrimSuffix(c.line, []byte("\r")))
+		c.line = c.line[:0]
+	}
+	return n, err
+}
+
+// parseLine handles one line of a header block.
+func (c *headerCaseConn) parseLine(line []byte) {
+	switch {
+	case c.status:
+		c.status = false
+		c.names = nil
+		// An interim 1xx response is followed by another header block
+		if bytes.HasPrefix(line, []byte("HTTP/1.")) && len(line) > 9 && line[9] == '1' {
+			c.names = append(c.names, "")
+		}
+	case len(line) == 0:
+		if len(c.names) > 0 && c.names[0] == "" {
+			c.status = true
+			return
+		}
+		c.last = c.names
+		c.reading = false
+	case line[0] == ' ' || line[0] == '\t':
+		// A folded continuation of the previous header
+	default:
+		if name, _, ok := bytes.Cut(line, []byte(":")); ok {
+			c.names = append(c.names, string(name))
+		}
+	}
+}
+
+// lastNames returns the header names of the last response read.
+func (c *headerCaseConn) lastNames() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.last
+}
+
+// headerCaseTransport hands the original header names of each backend
+// response to the request's headerCaseWriter.
+type headerCaseTransport struct {
+	next http.RoundTripper
+}
+
+func (t *headerCaseTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	w, _ := req.Context().Value(headerCaseContext{}).(*headerCaseWriter)
+	if w == nil {
+		return t.next.RoundTrip(req)
+	}
+
+	var conn *headerCaseConn
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			conn, _ = info.Conn.(*headerCaseConn)
+		},
+	}
+	resp, err := t.next.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	if err == nil && conn != nil {
+		w.names.Store(conn.lastNames())
+	}
+	return resp, err
+}
+
+// headerCaseWriter renames the response headers back to the spelling the
+// backend used just before they are written. Until then everything looks
+// headers up by their canonical names, and the reverse proxy canonicalizes
+// them as it copies them over.
+type headerCaseWriter struct {
+	http.ResponseWriter
+	names       atomic.Value // []string
+	wroteHeader bool
+}
+
+// preserveHeaderCase lets headerCaseTransport report the backend's header
+// names for requests through next.
+func preserveHeaderCase(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hw := &headerCaseWriter{ResponseWriter: w}
+		next.ServeHTTP(hw, r.WithContext(context.WithValue(r.Context(), headerCaseContext{}, hw)))
+	})
+}
+
+func (w *headerCaseWriter) WriteHeader(status int) {
+	if !w.wroteHeader && status >= 200 {
+		w.wroteHeader = true
+		w.restore()
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *headerCaseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *headerCaseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *headerCaseWriter) restore() {
+	names, _ := w.names.Load().([]string)
+	header := w.Header()
+	for _, name := range names {
+		canonical := textproto.CanonicalMIMEHeaderKey(name)
+		if name == canonical || framingHeaders[canonical] {
+			continue
+		}
+		if values, ok := header[canonical]; ok {
+			delete(header, canonical)
+			header[name] = values
+		}
+	}
+}
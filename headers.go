@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// headerRules removes and adds headers on a request or response. Removals
+// run first, so a header can be replaced by removing and adding it.
+type headerRules struct {
+	remove []string
+	add    [][2]string
+}
+
+// newHeaderRules parses "Name: Value" additions and bare header names to
+// remove.
+func newHeaderRules(add, remove []string) (*headerRules, error) {
+	rules := &headerRules{remove: remove}
+	for _, header := range add {
+		name, value, ok := strings.Cut(header, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("invalid header %q, expected \"Name: Value\"", header)
+		}
+		rules.add = append(rules.add, [2]string{name, strings.TrimSpace(value)})
+	}
+	for _, name := range remove {
+		if strings.ContainsAny(name, " \t:") {
+			return nil, fmt.Errorf("invalid header name %q", name)
+		}
+	}
+	return rules, nil
+}
+
+// apply edits h in place. Added values are appended, so repeating a header
+// sends every value.
+func (rules *headerRules) apply(h http.Header) {
+	for _, name := range rules.remove {
+		h.Del(name)
+	}
+	for _, header := range rules.add {
+		h.Add(header[0], header[1])
+	}
+}
+
+// forwardedHeaders names the headers that tell the backend how the client
+// reached the relay. An empty name leaves that header out.
+type forwardedHeaders struct {
+	host   string
+	proto  string
+	realIP string
+}
+
+// set replaces any values the client sent for the headers, so the backend
+// never sees a spoofed or duplicated value.
+func (f forwardedHeaders) set(req *http.Request, host, proto string) {
+	for _, header := range [][2]string{
+		{f.host, host},
+		{f.proto, proto},
+		{f.realIP, clientIP(req)},
+	} {
+		if header[0] != "" {
+			req.Header.Set(header[0], header[1])
+		}
+	}
+}
+
+// prepareForwardedFor decides which X-Forwarded-For chain the backend sees.
+// An inbound chain is kept, folded into a single header, only when the
+// client is trusted; otherwise it is dropped so clients cannot spoof it.
+// ReverseProxy appends the client's IP to whatever remains after the
+// Director returns.
+func prepareForwardedFor(req *http.Request, trusted bool) {
+	prior := req.Header.Values("X-Forwarded-For")
+	if !trusted || len(prior) == 0 {
+		req.Header.Del("X-Forwarded-For")
+		return
+	}
+	req.Header.Set("X-Forwarded-For", strings.Join(prior, ", "))
+}
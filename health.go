@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// serveBuiltins sends requests for the relay's own endpoints registered on mux
+// to their handlers and passes everything else through to next. The endpoint
+// paths are validated to be plain paths without a trailing slash, which the
+// mux matches exactly, and the admin API's patterns stay below its prefix, so
+// the mux never redirects or rejects proxied paths.
+func serveBuiltins(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The mux serves the match itself so wildcards reach r.PathValue
+		if _, pattern := mux.Handler(r); pattern != "" {
+			mux.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// healthHandler reports that the relay is up without contacting the backend.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// startupPollInterval is how often waitForBackend dials the backends.
+const startupPollInterval = time.Second
+
+// readinessProbe reports ready when at least one default backend accepts a TCP
+// connection. Results are cached for cacheTTL so frequent probes don't turn
+// into a dial per request. While starting is set, it reports not ready without
+// dialing.
+type readinessProbe struct {
+	live     *atomic.Pointer[liveSettings]
+	localIP  net.IP
+	timeout  time.Duration
+	cacheTTL time.Duration
+	starting atomic.Bool
+
+	// maintenance, if set, makes the probe report not ready while
+	// maintenance mode is on
+	maintenance *maintenanceMode
+
+	mu        sync.Mutex
+	checkedAt time.Time
+	ready     bool
+}
+
+func newReadinessProbe(live *atomic.Pointer[liveSettings], localIP net.IP, timeout, cacheTTL time.Duration) *readinessProbe {
+	return &readinessProbe{live: live, localIP: localIP, timeout: timeout, cacheTTL: cacheTTL}
+}
+
+// check returns the cached result if it is still fresh, otherwise it dials the
+// backends. Holding the lock while dialing makes concurrent callers share one
+// probe.
+func (p *readinessProbe) check() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.checkedAt.IsZero() && time.Since(p.checkedAt) < p.cacheTTL {
+		return p.ready
+	}
+
+	p.ready = p.dial(warnf)
+	p.checkedAt = time.Now()
+
+	return p.ready
+}
+
+// dial reports whether any default backend accepts a connection, passing
+// each failure to logf.
+func (p *readinessProbe) dial(logf func(format string, args ...any)) bool {
+	for _, b := range p.live.Load().pool.backends {
+		network, addr := b.address()
+		conn, err := dialFrom(p.localIP, network, addr, p.timeout)
+		if err != nil {
+			logf("Readiness probe failed for %s: %v", addr, err)
+			continue
+		}
+		conn.Close()
+		return true
+	}
+	return false
+}
+
+// waitForBackend polls the backends after startup and clears starting once
+// one accepts a connection, or once wait has passed without any doing so.
+// From then on readiness follows the regular probe.
+func (p *readinessProbe) waitForBackend(wait time.Duration) {
+	defer p.starting.Store(false)
+
+	start := time.Now()
+	infof("Reporting not ready until a backend accepts a connection, for at most %s", wait)
+	for attempt := 1; ; attempt++ {
+		if p.dial(debugf) {
+			infof("Backend reachable after %s, reporting ready", time.Since(start).Round(time.Millisecond))
+			return
+		}
+		if time.Since(start) >= wait {
+			warnf("No backend reachable after %s, readiness now follows the regular probe", wait)
+			return
+		}
+		infof("Waiting for a backend to accept connections (attempt %d)", attempt)
+		time.Sleep(startupPollInterval)
+	}
+}
+
+func (p *readinessProbe) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if p.starting.Load() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "starting"})
+		return
+	}
+	if p.maintenance != nil && p.maintenance.on.Load() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "maintenance"})
+		return
+	}
+	if !p.check() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "unavailable"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+}
+
+// writeJSON writes v as a JSON response body with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// healthChecker probes backends in the background and takes failing ones
+// out of rotation. A backend is marked down after fall failed checks in a
+// row and rejoins after rise successful ones.
+type healthChecker struct {
+	client   *http.Client
+	localIP  net.IP
+	path     string
+	interval time.Duration
+	timeout  time.Duration
+	rise     int
+	fall     int
+	metrics  *relayMetrics
+}
+
+// newHealthChecker probes with an HTTP GET for path over transport, or with
+// a plain connection when path is empty. metrics may be nil.
+func newHealthChecker(config *Config, transport http.RoundTripper, metrics *relayMetrics) *healthChecker {
+	return &healthChecker{
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   config.HealthCheckTimeout,
+			// A redirect is an answer; don't chase it
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		localIP:  net.ParseIP(config.BackendLocalAddr),
+		path:     config.HealthCheckPath,
+		interval: config.HealthCheckInterval,
+		timeout:  config.HealthCheckTimeout,
+		rise:     config.HealthCheckRise,
+		fall:     config.HealthCheckFall,
+		metrics:  metrics,
+	}
+}
+
+// watch starts checking every backend in pools and returns a function that
+// stops the checks.
+func (c *healthChecker) watch(pools ...*backendPool) (stop func()) {
+	done := make(chan struct{})
+	for _, pool := range pools {
+		for _, b := range pool.backends {
+			go c.run(b, done)
+		}
+	}
+	return func() { close(done) }
+}
+
+func (c *healthChecker) run(b *backend, done <-chan struct{}) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	var successes, failures int
+	for {
+		if err := c.probe(b); err != nil {
+			successes = 0
+			failures++
+			if !b.down.Load() && failures >= c.fall {
+				b.down.Store(true)
+				warnf("Backend %s is down after %d failed health checks: %v", b, failures, err)
+			}
+		} else {
+			failures = 0
+			successes++
+			if b.down.Load() && successes >= c.rise {
+				b.down.Store(false)
+				infof("Backend %s is back up after %d successful health checks", b, successes)
+			}
+		}
+		if c.metrics != nil {
+			c.metrics.setBackendUp(b.id(), !b.down.Load())
+		}
+
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe checks b once. Any response below 500 counts as healthy.
+func (c *healthChecker) probe(b *backend) error {
+	if c.path == "" {
+		network, addr := b.address()
+		conn, err := dialFrom(c.localIP, network, addr, c.timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, b.url.String()+c.path, nil)
+	if err != nil {
+		return err
+	}
+	req.Host = b.hostHeader()
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("%s returned %s", c.path, resp.Status)
+	}
+	return nil
+}
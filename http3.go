@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http/httpguts"
+)
+
+// newHTTP3Servers returns an HTTP/3 server for every listen address. They
+// serve handler on the same port as the TLS listener, over UDP, with the
+// same certificates.
+func newHTTP3Servers(config *Config, handler http.Handler, tlsConfig *tls.Config) []*http3.Server {
+	var servers []*http3.Server
+	for _, host := range listenHosts(config.Host) {
+		servers = append(servers, &http3.Server{
+			Addr:           net.JoinHostPort(host, strconv.Itoa(config.Port)),
+			Handler:        handler,
+			TLSConfig:      http3.ConfigureTLSConfig(tlsConfig),
+			MaxHeaderBytes: config.MaxHeaderBytes,
+			IdleTimeout:    config.IdleTimeout,
+		})
+	}
+	return servers
+}
+
+// bindHTTP3 opens the UDP sockets for servers, in the same order, closing
+// them all if any fails.
+func bindHTTP3(servers []*http3.Server) ([]net.PacketConn, error) {
+	var conns []net.PacketConn
+	for _, s := range servers {
+		conn, err := net.ListenPacket("udp", s.Addr)
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return nil, fmt.Errorf("HTTP/3: %v", listenError(s.Addr, "--port", err))
+		}
+		conns = append(conns, conn)
+	}
+	return conns, nil
+}
+
+// validAltSvc loosely checks an Alt-Svc header value: "clear", or a
+// comma-separated list of protocol="authority" entries with optional
+// parameters, such as h3=":443"; ma=86400.
+func validAltSvc(value string) bool {
+	if !httpguts.ValidHeaderFieldValue(value) {
+		return false
+	}
+	if strings.TrimSpace(value) == "clear" {
+		return true
+	}
+	for _, entry := range strings.Split(value, ",") {
+		alternative, _, _ := strings.Cut(entry, ";")
+		protocol, authority, ok := strings.Cut(strings.TrimSpace(alternative), "=")
+		if !ok || protocol == "" || len(authority) < 2 || authority[0] != '"' || authority[len(authority)-1] != '"' {
+			return false
+		}
+	}
+	return true
+}
+
+// advertiseHTTP3 tells HTTP/1.1 and HTTP/2 clients that HTTP/3 is available
+// on port, so browsers switch to it for later requests.
+func advertiseHTTP3(port int, next http.Handler) http.Handler {
+	altSvc := fmt.Sprintf(`h3=":%d"; ma=86400`, port)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor < 3 {
+			w.Header().Add("Alt-Svc", altSvc)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
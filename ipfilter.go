@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ipFilter admits clients by IP. Deny rules take precedence; when allow
+// rules exist, only addresses inside them are admitted.
+type ipFilter struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+func newIPFilter(allow, deny []string) (*ipFilter, error) {
+	filter := &ipFilter{}
+	var err error
+	if filter.allow, err = parsePrefixes(allow); err != nil {
+		return nil, err
+	}
+	if filter.deny, err = parsePrefixes(deny); err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+// parsePrefixes parses CIDR blocks. Bare addresses are treated as a single
+// host.
+func parsePrefixes(values []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			addr, err := netip.ParseAddr(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR %q: %v", value, err)
+			}
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %v", value, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func (f *ipFilter) empty() bool {
+	return len(f.allow) == 0 && len(f.deny) == 0
+}
+
+// allowed decides whether a client address may use the relay.
+func (f *ipFilter) allowed(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range f.deny {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, prefix := range f.allow {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// middleware answers 403 to clients the filter rejects.
+func (f *ipFilter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr, err := netip.ParseAddr(clientIP(r))
+		if err != nil || !f.allowed(addr) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
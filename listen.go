@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// listenHosts splits a comma-separated --host value into bare host names or
+// addresses, unwrapping bracketed IPv6 addresses.
+func listenHosts(hosts string) []string {
+	var out []string
+	for _, host := range splitList(hosts) {
+		out = append(out, strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"))
+	}
+	return out
+}
+
+// validateListenHosts rejects --host entries that cannot be combined with a
+// port into a listen address.
+func validateListenHosts(hosts string) error {
+	entries := listenHosts(hosts)
+	if len(entries) == 0 {
+		return fmt.Errorf("--host has no addresses")
+	}
+	for _, host := range entries {
+		if net.ParseIP(host) == nil && (host == "" || strings.ContainsAny(host, ":/ ")) {
+			return fmt.Errorf("invalid --host address %q, expected an IP address or host name without a port", host)
+		}
+	}
+	return nil
+}
+
+// bindListeners opens every listener the relay serves on: the sockets
+// passed in by systemd socket activation if there are any, else the Unix
+// socket if one is configured, otherwise one TCP listener per --host
+// address. If any address fails, the listeners already opened are closed
+// again.
+func bindListeners(config *Config) ([]net.Listener, error) {
+	activated, err := activatedListeners()
+	if err != nil || len(activated) > 0 {
+		if err == nil {
+			infof("Using the sockets passed in by systemd socket activation")
+		}
+		return activated, err
+	}
+
+	if config.ListenSocket != "" {
+		mode, err := parseFileMode(config.ListenSocketMode)
+		if err != nil {
+			return nil, err
+		}
+		listener, err := listenUnix(config.ListenSocket, mode)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{listener}, nil
+	}
+
+	var listeners []net.Listener
+	port := config.Port
+	for _, host := range listenHosts(config.Host) {
+		addr := net.JoinHostPort(host, strconv.Itoa(port))
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, listenError(addr, "--port", err)
+		}
+		listeners = append(listeners, listener)
+
+		// With --port 0 the first address gets a free port from the OS, and
+		// the others listen on the same one
+		if port == 0 {
+			port = listener.Addr().(*net.TCPAddr).Port
+			infof("Listening on port %d picked by the OS", port)
+		}
+	}
+	return listeners, nil
+}
+
+// listenError explains a failure to listen on addr, naming the flag that
+// picks a different address when another process already holds it.
+func listenError(addr, flag string, err error) error {
+	if errors.Is(err, syscall.EADDRINUSE) {
+		return fmt.Errorf("%s is already in use by another process; stop it or change %s", addr, flag)
+	}
+	return err
+}
+
+// listenerName describes a listener for log output.
+func listenerName(l net.Listener) string {
+	if l.Addr().Network() == "unix" {
+		return "unix:" + l.Addr().String()
+	}
+	return l.Addr().String()
+}
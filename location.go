@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// publicOriginContext carries the scheme and host clients use to reach the
+// relay from the proxy handler to ModifyResponse.
+type publicOriginContext struct{}
+
+type publicOrigin struct {
+	scheme string
+	host   string
+}
+
+// withPublicOrigin records the origin of each request for Location
+// rewriting. publicHost, when set, replaces the Host header sent by the
+// client, for relays that sit behind another proxy.
+func withPublicOrigin(publicHost string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := publicOrigin{scheme: "https", host: r.Host}
+		if r.TLS == nil {
+			origin.scheme = "http"
+		}
+		if publicHost != "" {
+			origin.host = publicHost
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), publicOriginContext{}, origin)))
+	})
+}
+
+// publicOriginOf returns the origin recorded by withPublicOrigin.
+func publicOriginOf(req *http.Request) publicOrigin {
+	origin, _ := req.Context().Value(publicOriginContext{}).(publicOrigin)
+	return origin
+}
+
+// rewriteBackendLocation points a Location header that names the backend's
+// own address at the relay instead, and upgrades plain http links to the
+// relay's host to its scheme. Other locations are left alone.
+func rewriteBackendLocation(resp *http.Response) {
+	origin := publicOriginOf(resp.Request)
+	location := resp.Header.Get("Location")
+	u, err := url.Parse(location)
+	if origin.host == "" || location == "" || err != nil || u.Host == "" {
+		return
+	}
+
+	switch {
+	case strings.EqualFold(u.Host, resp.Request.Host):
+	case u.Scheme == "http" && origin.scheme == "https" && strings.EqualFold(u.Host, origin.host):
+	default:
+		return
+	}
+
+	u.Scheme = origin.scheme
+	u.Host = origin.host
+	resp.Header.Set("Location", u.String())
+}
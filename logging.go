@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// logLevels maps --log-level values onto slog levels.
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// setupLogger configures the process-wide logger for the given format and
+// level, and returns the logger for access log entries. In "json" mode slog
+// becomes the default, which also routes plain log.Printf output through the
+// JSON handler. In "text" mode slog writes through the standard log output.
+// With --log-file or --access-log-file set, output goes to those files
+// instead of stderr.
+func setupLogger(config *Config) (*slog.Logger, logFiles) {
+	var files logFiles
+	var out io.Writer = os.Stderr
+	if config.LogFile != "" {
+		// Application logs are low volume; lumberjack's 100MB default
+		// rotation is plenty
+		f := &lumberjack.Logger{Filename: config.LogFile}
+		files = append(files, f)
+		out = f
+		log.SetOutput(f)
+	}
+	level := logLevels[config.LogLevel]
+	slog.SetLogLoggerLevel(level)
+	if config.LogFormat == "json" {
+		slog.SetDefault(slog.New(slog.NewJSONHandler(out, &slog.HandlerOptions{Level: level})))
+	}
+
+	if config.AccessLogFile == "" {
+		// Access entries are logged at info level but are not subject to
+		// --log-level, so quieter application logs keep them
+		return slog.New(accessHandler{slog.Default().Handler()}), files
+	}
+	f := &lumberjack.Logger{
+		Filename:   config.AccessLogFile,
+		MaxSize:    config.AccessLogMaxSize,
+		MaxBackups: config.AccessLogMaxBackups,
+	}
+	files = append(files, f)
+	if config.LogFormat == "json" {
+		return slog.New(slog.NewJSONHandler(f, nil)), files
+	}
+	return slog.New(slog.NewTextHandler(f, nil)), files
+}
+
+// accessHandler lets every entry through to the wrapped handler, whatever
+// level that handler was configured with.
+type accessHandler struct {
+	slog.Handler
+}
+
+func (h accessHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h accessHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return accessHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h accessHandler) WithGroup(name string) slog.Handler {
+	return accessHandler{h.Handler.WithGroup(name)}
+}
+
+// debugf, infof, warnf and errorf log a formatted message at their level.
+func debugf(format string, args ...any) { logf(slog.LevelDebug, format, args...) }
+func infof(format string, args ...any)  { logf(slog.LevelInfo, format, args...) }
+func warnf(format string, args ...any)  { logf(slog.LevelWarn, format, args...) }
+func errorf(format string, args ...any) { logf(slog.LevelError, format, args...) }
+
+func logf(level slog.Level, format string, args ...any) {
+	ctx := context.Background()
+	if slog.Default().Enabled(ctx, level) {
+		slog.Log(ctx, level, fmt.Sprintf(format, args...))
+	}
+}
+
+// logFiles are the log files the relay writes to, if any.
+type logFiles []*lumberjack.Logger
+
+// open creates the files up front so an unwritable path fails at startup
+// rather than losing log entries.
+func (files logFiles) open() error {
+	for _, f := range files {
+		if _, err := f.Write(nil); err != nil {
+			return fmt.Errorf("cannot open log file %s: %v", f.Filename, err)
+		}
+	}
+	return nil
+}
+
+// reopen closes the files; the next write opens them again under their
+// configured names. After an external tool such as logrotate has moved a
+// file away, this starts a fresh one.
+func (files logFiles) reopen() {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// statusRecorder captures the status code and body size written through an
+// http.ResponseWriter.
+type statusRecorder struct {
+	http.ResponseWriter
+	status  int
+	bytes   int64
+	connect bool
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Hijack records a protocol switch, or for a CONNECT request the tunnel
+// being established, before handing over the connection. Once
+// hijacked, net/http clears the server's read and write deadlines, so
+// long-lived upgraded connections such as WebSockets are not cut off by
+// --read-timeout or --write-timeout.
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(r.ResponseWriter).Hijack()
+	if err == nil && r.status == 0 {
+		r.status = http.StatusSwitchingProtocols
+		if r.connect {
+			r.status = http.StatusOK
+		}
+	}
+	return conn, brw, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer so
+// flushing and connection hijacking keep working through the recorder.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// accessLog emits one entry per request to logger once next has finished.
+// Requests over TLS also record the negotiated version and cipher suite and
+// the SNI server name the client asked for, to find clients still on weak
+// TLS settings.
+func accessLog(logger *slog.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, connect: r.Method == http.MethodConnect}
+
+		next.ServeHTTP(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		attrs := []any{
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"bytes", rec.bytes,
+			"remote_ip", clientIP(r),
+			"request_id", r.Header.Get(requestIDHeader),
+			"duration_ms", float64(time.Since(start).Microseconds()) / 1000,
+		}
+		if r.TLS != nil {
+			attrs = append(attrs,
+				"tls_version", tls.VersionName(r.TLS.Version),
+				"tls_cipher", tls.CipherSuiteName(r.TLS.CipherSuite),
+				"tls_server_name", r.TLS.ServerName,
+			)
+		}
+		logger.Info("request", attrs...)
+	})
+}
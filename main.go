@@ -2,177 +2,545 @@ package main
 
 import (
 	"context"
-	"flag"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
-	"mime"
+	"net"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
 	"os"
 	"os/signal"
-	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"golang.org/x/crypto/acme/autocert"
 )
 
-type Config struct {
-	Host      string
-	Port      int
-	ProxyHost string
-	ProxyPort int
-	CertFile  string
-	KeyFile   string
+func main() {
+	// Parse command line flags
+	config := parseFlags()
+	if err := run(config, nil); err != nil {
+		// Report errors the log can't be used for on stderr
+		var stderr stderrError
+		if errors.As(err, &stderr) {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		log.Fatal(err)
+	}
 }
 
-func parseFlags() *Config {
-	config := &Config{}
+// stderrError is an error main reports on stderr rather than in the log:
+// the answer to --check, or a log file that can't be opened.
+type stderrError struct {
+	err error
+}
 
-	// Define flags
-	flag.StringVar(&config.Host, "host", "", "Host address to listen on (required)")
-	flag.IntVar(&config.Port, "port", 0, "Port to listen on (required)")
-	flag.StringVar(&config.ProxyHost, "proxy-for-host", "", "Host to proxy requests to (required)")
-	flag.IntVar(&config.ProxyPort, "proxy-for-port", 0, "Port to proxy requests to (required)")
-	flag.StringVar(&config.CertFile, "cert", "", "Path to TLS certificate file (required)")
-	flag.StringVar(&config.KeyFile, "key", "", "Path to TLS key file (required)")
+func (e stderrError) Error() string { return e.err.Error() }
+func (e stderrError) Unwrap() error { return e.err }
 
-	// Custom usage message
-	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "All flags are required:\n")
-		flag.PrintDefaults()
-		fmt.Fprintf(os.Stderr, "\nExample:\n")
-		fmt.Fprintf(os.Stderr, "  %s --host 0.0.0.0 --port 443 --proxy-for-host 127.0.0.1 --proxy-for-port 8443 --cert cert.crt --key key.pem\n", os.Args[0])
+// run starts the relay as config describes and serves until a signal shuts
+// it down, returning once in-flight requests have drained. It returns early
+// if the relay cannot start or a server fails. Proxied requests reach the
+// backends through transport, or a transport built from config if it is nil.
+func run(config *Config, transport http.RoundTripper) error {
+	if config.Version {
+		fmt.Println(currentBuild())
+		return nil
 	}
+	accessLogger, logFiles := setupLogger(config)
 
-	flag.Parse()
+	if config.Check {
+		if err := checkConfig(config); err != nil {
+			return stderrError{err}
+		}
+		fmt.Println("Configuration OK")
+		return nil
+	}
+	if err := logFiles.open(); err != nil {
+		return stderrError{err}
+	}
 
-	// Verify all required flags are provided
-	var missingFlags []string
+	// Export traces if a collector is configured
+	var shutdownTracing func(context.Context) error
+	if config.OTLPEndpoint != "" {
+		var err error
+		shutdownTracing, err = setupTracing(config.OTLPEndpoint, config.OTelServiceName)
+		if err != nil {
+			return err
+		}
+	}
 
-	if config.Host == "" {
-		missingFlags = append(missingFlags, "host")
+	var metrics *relayMetrics
+	if config.MetricsPath != "" {
+		metrics = newRelayMetrics()
 	}
-	if config.Port == 0 {
-		missingFlags = append(missingFlags, "port")
+
+	// Domains served with their own certificate and backends
+	domains, err := newDomainRouter(config.Domains, config.ProxyPort, backendScheme(config), config.StripPrefix, config.StrictCertValidity)
+	if err != nil {
+		return err
 	}
-	if config.ProxyHost == "" {
-		missingFlags = append(missingFlags, "proxy-for-host")
+	domains.logDomains()
+
+	// Health check the backends in the background if enabled
+	var checker *healthChecker
+	if config.HealthCheckInterval > 0 {
+		probeTransport, err := newTransport(config)
+		if err != nil {
+			return err
+		}
+		checker = newHealthChecker(config, probeTransport, metrics)
+		checker.watch(domains.pools()...)
 	}
-	if config.ProxyPort == 0 {
-		missingFlags = append(missingFlags, "proxy-for-port")
+
+	// The default backends, routes, header rules and the rate limit can be
+	// swapped on reload
+	var live atomic.Pointer[liveSettings]
+	settings, err := newLiveSettings(config, nil, checker)
+	if err != nil {
+		return err
 	}
-	if config.CertFile == "" {
-		missingFlags = append(missingFlags, "cert")
+	live.Store(settings)
+	settings.logRoutes(nil)
+
+	// Register custom MIME types before any responses are fixed up
+	if err := registerMimeTypes(config.MimeTypes); err != nil {
+		return err
 	}
-	if config.KeyFile == "" {
-		missingFlags = append(missingFlags, "key")
+
+	// Cache static assets in memory if enabled
+	staticExtensions := newExtensionSet(config.StaticExtensions)
+	var cache *responseCache
+	if config.CacheTTL > 0 {
+		cache = newResponseCache(config.CacheTTL, config.CacheMaxSize, config.MaxBufferedBody, staticExtensions)
 	}
 
-	if len(missingFlags) > 0 {
-		fmt.Fprintf(os.Stderr, "Error: missing required flags: %v\n\n", missingFlags)
-		flag.Usage()
-		os.Exit(1)
+	// Create a reverse proxy, answering with the error page once any retries
+	// are exhausted
+	errorPages, err := newErrorPage(config.ErrorPage)
+	if err != nil {
+		return err
+	}
+	if transport == nil {
+		transport, err = newTransport(config)
+		if err != nil {
+			return err
+		}
+	}
+	proxy, err := newProxy(config, transport, &live, domains, metrics, cache, errorPages)
+	if err != nil {
+		return err
 	}
 
-	return config
-}
+	mount := newMountPath(config.MountPath)
+	var proxied http.Handler = withRouteSlot(proxy)
+	if config.PreserveHeaderCase {
+		proxied = preserveHeaderCase(proxied)
+	}
+	if config.CanaryCookie != "" {
+		proxied = newCanaryPinning(config.CanaryCookie, mount, &live).middleware(proxied)
+	}
+	var handler http.Handler = withPublicOrigin(config.PublicHost, withResponseController(proxied))
+	if config.MaxRequestBody > 0 {
+		handler = limitRequestBody(config.MaxRequestBody, handler)
+	}
+	if mount != "" {
+		handler = mount.middleware(handler)
+	}
+	if cache != nil {
+		handler = cache.middleware(handler)
+	}
+	if config.AllowConnect {
+		handler = tunnelConnect(&live, net.ParseIP(config.BackendLocalAddr), handler)
+	}
+	handler = rateLimited(&live, handler)
+	if len(config.AllowMethods) > 0 {
+		methods, err := newMethodFilter(config.AllowMethods)
+		if err != nil {
+			return err
+		}
+		handler = methods.middleware(handler)
+	}
+	if config.RejectUnknownHosts {
+		handler = domains.rejectUnknown(handler)
+	}
+	handler = trailingSlash(config.TrailingSlash, config.TrailingSlashPaths, handler)
+	handler = normalizePaths(config.PathNormalization, handler)
 
-func main() {
-	// Parse command line flags
-	config := parseFlags()
+	// Answer proxied requests with 503 in maintenance mode. The built-in
+	// endpoints, the admin API among them, stay up.
+	maintenance, err := newMaintenanceMode(config.MaintenancePage, config.MaintenanceRetryAfter)
+	if err != nil {
+		return err
+	}
+	maintenance.set(config.Maintenance)
+	handler = maintenance.middleware(handler)
 
-	// Verify certificate files exist
-	if _, err := os.Stat(config.CertFile); os.IsNotExist(err) {
-		log.Fatalf("Certificate file not found: %s", config.CertFile)
+	// Serve built-in endpoints ahead of the proxy
+	mux := http.NewServeMux()
+	if config.HealthPath != "" {
+		mux.HandleFunc(config.HealthPath, healthHandler)
+	}
+	if config.ReadyPath != "" {
+		probe := newReadinessProbe(&live, net.ParseIP(config.BackendLocalAddr), config.ReadyTimeout, config.ReadyCacheTTL)
+		if config.StartupWait > 0 {
+			probe.starting.Store(true)
+			go probe.waitForBackend(config.StartupWait)
+		}
+		if config.MaintenanceFailReady {
+			probe.maintenance = maintenance
+		}
+		mux.Handle(config.ReadyPath, probe)
+	}
+	if metrics != nil {
+		mux.Handle(config.MetricsPath, metrics.handler())
 	}
-	if _, err := os.Stat(config.KeyFile); os.IsNotExist(err) {
-		log.Fatalf("Key file not found: %s", config.KeyFile)
+	if config.VersionPath != "" {
+		mux.HandleFunc(config.VersionPath, versionHandler)
 	}
 
-	// Construct target URL
-	targetURL := fmt.Sprintf("http://%s:%d", config.ProxyHost, config.ProxyPort)
-	target, err := url.Parse(targetURL)
-	if err != nil {
-		log.Fatal(err)
+	// Count in-flight requests to report on the drain at shutdown and on the
+	// status page
+	active := &activeRequests{}
+	conns := &connCounter{}
+	if config.StatusPath != "" {
+		mux.Handle(config.StatusPath, &statusPage{
+			started: time.Now(),
+			token:   config.StatusToken,
+			active:  active,
+			conns:   conns,
+			live:    &live,
+			checked: checker != nil,
+			cache:   cache,
+		})
 	}
 
-	// Create a reverse proxy
-	proxy := httputil.NewSingleHostReverseProxy(target)
+	if config.AdminPath != "" {
+		admin := &adminAPI{token: config.AdminToken, live: &live, domains: domains, metrics: metrics, maintenance: maintenance}
+		admin.register(mux, normalizePrefix(config.AdminPath))
+	}
 
-	// Customize the director
-	proxy.Director = func(req *http.Request) {
-		req.URL.Scheme = target.Scheme
-		req.URL.Host = target.Host
-		req.Host = target.Host
+	// Gate the relay behind basic auth, optionally leaving the built-in
+	// endpoints open for probes and scrapers
+	basicAuthEnabled := config.BasicAuthUser != ""
+	if basicAuthEnabled && config.BasicAuthExemptBuiltins {
+		handler = basicAuth(config.BasicAuthUser, config.BasicAuthPass, handler)
+	}
+	frontend := serveBuiltins(mux, handler)
+	if basicAuthEnabled && !config.BasicAuthExemptBuiltins {
+		frontend = basicAuth(config.BasicAuthUser, config.BasicAuthPass, frontend)
+	}
 
-		// Add standard proxy headers
-		req.Header.Add("X-Forwarded-Host", req.Host)
-		req.Header.Add("X-Forwarded-Proto", req.URL.Scheme)
-		req.Header.Add("X-Real-IP", req.RemoteAddr)
+	// Answer CORS preflights ahead of basic auth, since browsers send them
+	// without credentials
+	if len(config.CORSAllowedOrigins) > 0 {
+		cors, err := newCORSPolicy(config.CORSAllowedOrigins, config.CORSAllowedMethods, config.CORSAllowedHeaders)
+		if err != nil {
+			return err
+		}
+		frontend = cors.middleware(frontend)
 	}
 
-	// Fix MIME types based on file extension
-	proxy.ModifyResponse = func(resp *http.Response) error {
-		// Get the request path
-		path := resp.Request.URL.Path
+	// Restrict which client addresses may use the relay at all
+	ipRules, err := newIPFilter(config.AllowCIDRs, config.DenyCIDRs)
+	if err != nil {
+		return err
+	}
+	if !ipRules.empty() {
+		frontend = ipRules.middleware(frontend)
+	}
 
-		// Detect MIME type from file extension
-		ext := filepath.Ext(path)
-		if ext != "" {
-			correctMimeType := mime.TypeByExtension(ext)
+	// Obtain certificates via ACME, or load them up front from disk and pick
+	// up renewed certificates as the files change
+	var getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	var acmeManager *autocert.Manager
+	var fromDisk []*certReloader
+	if len(config.ACMEDomains) > 0 {
+		acmeManager, err = newACMEManager(config)
+		if err != nil {
+			return err
+		}
+		getCertificate = acmeManager.GetCertificate
+	} else if config.CertFile != "" {
+		// Verify certificate files exist
+		if _, err := os.Stat(config.CertFile); os.IsNotExist(err) {
+			return fmt.Errorf("certificate file not found: %s", config.CertFile)
+		}
+		if _, err := os.Stat(config.KeyFile); os.IsNotExist(err) {
+			return fmt.Errorf("key file not found: %s", config.KeyFile)
+		}
 
-			// If we detected a MIME type, update the Content-Type header
-			if correctMimeType != "" {
-				currentContentType := resp.Header.Get("Content-Type")
+		certs, err := newCertReloader(config.CertFile, config.KeyFile, config.StrictCertValidity)
+		if err != nil {
+			return err
+		}
+		if config.CertReloadInterval > 0 {
+			go certs.watch(config.CertReloadInterval)
+		}
+		getCertificate = certs.GetCertificate
+		fromDisk = append(fromDisk, certs)
+	} else if config.SelfSigned {
+		names := selfSignedNames(config.Host, config.SelfSignedHosts)
+		cert, err := newSelfSignedCert(names)
+		if err != nil {
+			return fmt.Errorf("generating self-signed certificate: %w", err)
+		}
+		warnf("Serving a self-signed certificate for %s; clients will not trust it", strings.Join(names, ", "))
+		infof("Self-signed certificate SHA-256 fingerprint: %s", certFingerprint(cert.Certificate[0]))
+		getCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return cert, nil }
+	}
+	if getCertificate != nil {
+		getCertificate = domains.getCertificate(getCertificate)
+		if config.CertReloadInterval > 0 {
+			domains.watch(config.CertReloadInterval)
+		}
+		fromDisk = append(fromDisk, domains.reloaders()...)
+	}
+	if config.CertExpiryInterval > 0 && len(fromDisk) > 0 {
+		monitor := &certExpiryMonitor{
+			certs:     fromDisk,
+			threshold: config.CertExpiryWarning,
+			interval:  config.CertExpiryInterval,
+			metrics:   metrics,
+		}
+		go monitor.run()
+	}
 
-				// Only override if the current type is wrong or generic
-				if currentContentType == "" ||
-					currentContentType == "text/plain" ||
-					currentContentType == "application/octet-stream" {
-					resp.Header.Set("Content-Type", correctMimeType)
-					log.Printf("Fixed MIME type for %s: %s -> %s", path, currentContentType, correctMimeType)
-				}
-			}
+	// Without certificates, which is only allowed with --no-tls or on a Unix
+	// socket, serve plain HTTP
+	var tlsConfig *tls.Config
+	if config.NoTLS {
+		warnf("TLS is disabled by --no-tls: traffic is served as plain HTTP and must not be exposed beyond local development")
+	}
+	if getCertificate != nil {
+		tlsConfig, err = newTLSConfig(config, getCertificate)
+		if err != nil {
+			return err
 		}
+	}
 
-		return nil
+	// Start a server span for each request, continuing the client's trace
+	if shutdownTracing != nil {
+		frontend = otelhttp.NewHandler(frontend, "relay")
+	}
+
+	// Count in-flight requests, and turn panics into 500 responses that
+	// still reach the access log
+	frontend = recoverPanics(config.LogPanicStacks, errorPages, active.middleware(frontend))
+
+	// Take the client address from X-Forwarded-For behind trusted proxies,
+	// before anything logs or limits by it
+	proxies, err := newTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		return err
 	}
 
-	// Add error handling
-	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
-		log.Printf("Proxy error: %v", err)
-		w.WriteHeader(http.StatusBadGateway)
+	// Create server with timeouts. It serves every listen address.
+	handler = withRequestID(withClientIP(proxies, accessLog(accessLogger, frontend)))
+
+	// Optionally serve HTTP/3 over QUIC on the same port, and point TLS
+	// clients at it
+	var h3Servers []*http3.Server
+	if config.HTTP3 {
+		h3Servers = newHTTP3Servers(config, handler, tlsConfig)
+		if config.AltSvc == "" {
+			handler = advertiseHTTP3(config.Port, handler)
+		}
 	}
 
-	// Create server with timeouts
 	server := &http.Server{
-		Addr:         fmt.Sprintf("%s:%d", config.Host, config.Port),
-		Handler:      proxy,
-		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 15 * time.Second,
-		IdleTimeout:  60 * time.Second,
+		Handler:           handler,
+		TLSConfig:         tlsConfig,
+		ReadTimeout:       config.ReadTimeout,
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+		MaxHeaderBytes:    config.MaxHeaderBytes,
+		ConnState:         conns.track,
+	}
+	if config.ConnectionMaxLifetime > 0 {
+		server.Handler = limitConnLifetime(config.ConnectionMaxLifetime, handler)
+		server.ConnContext = markConnStart
+	}
+
+	servers := []*http.Server{server}
+
+	// The first of the other servers to fail stops the relay
+	failed := make(chan error, 1)
+	fail := func(err error) {
+		select {
+		case failed <- err:
+		default:
+		}
+	}
+
+	// Optionally redirect plain HTTP to HTTPS. ACME HTTP-01 challenges are
+	// answered on the same listener, which defaults to port 80 in that mode.
+	redirectPort := config.HTTPRedirectPort
+	if acmeManager != nil && redirectPort == 0 {
+		redirectPort = 80
+	}
+	if redirectPort != 0 {
+		redirectHandler := redirectToHTTPS(config.Port)
+		if acmeManager != nil {
+			redirectHandler = acmeManager.HTTPHandler(redirectHandler)
+		}
+		for _, host := range listenHosts(config.Host) {
+			redirectServer := newRedirectServer(net.JoinHostPort(host, strconv.Itoa(redirectPort)), redirectHandler, config)
+			servers = append(servers, redirectServer)
+
+			go func() {
+				infof("Redirecting HTTP on %s to HTTPS", redirectServer.Addr)
+				if err := redirectServer.ListenAndServe(); err != http.ErrServerClosed {
+					fail(fmt.Errorf("HTTP redirect server: %w", listenError(redirectServer.Addr, "--http-redirect-port", err)))
+				}
+			}()
+		}
+	}
+
+	// Serve profiles on their own listener if enabled
+	if config.PprofAddr != "" {
+		pprofServer := newPprofServer(config.PprofAddr)
+		servers = append(servers, pprofServer)
+		if !isLoopbackAddr(config.PprofAddr) {
+			warnf("pprof endpoints on %s are reachable from other machines; bind --pprof-addr to localhost or an internal interface", config.PprofAddr)
+		}
+
+		go func() {
+			infof("Serving pprof on http://%s/debug/pprof/", pprofServer.Addr)
+			if err := pprofServer.ListenAndServe(); err != http.ErrServerClosed {
+				fail(fmt.Errorf("pprof server: %w", listenError(pprofServer.Addr, "--pprof-addr", err)))
+			}
+		}()
 	}
 
-	// Handle graceful shutdown
+	// Handle graceful shutdown. Signals are registered before the server
+	// starts so an early SIGTERM still drains instead of killing the process.
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigChan)
+
+	// On SIGHUP reopen log files, as logrotate expects after moving them,
+	// and reload the config file
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	defer signal.Stop(hupChan)
+	go func() {
+		for range hupChan {
+			if len(logFiles) > 0 {
+				logFiles.reopen()
+				infof("Reopened log files")
+			}
+			if config.ConfigFile != "" {
+				reloadConfig(config, os.Args[1:], checker, &live)
+			}
+		}
+	}()
+
+	// SIGUSR1 switches maintenance mode on and off
+	usr1Chan := make(chan os.Signal, 1)
+	signal.Notify(usr1Chan, syscall.SIGUSR1)
+	defer signal.Stop(usr1Chan)
+	go func() {
+		for range usr1Chan {
+			maintenance.toggle()
+		}
+	}()
+
+	shutdownDone := make(chan struct{})
 	go func() {
-		sigChan := make(chan os.Signal, 1)
-		signal.Notify(sigChan, os.Interrupt)
-		<-sigChan
+		defer close(shutdownDone)
+		sig := <-sigChan
 
-		log.Println("Shutting down server...")
-		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		infof("Received %v, shutting down server...", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
 		defer cancel()
+		go active.reportDrain(ctx, time.Second)
 
-		if err := server.Shutdown(ctx); err != nil {
-			log.Printf("Server shutdown error: %v", err)
+		// Answer in-flight requests with Connection: close on every server up
+		// front, so clients do not send more requests over connections that
+		// are about to close, and idle ones close right away rather than
+		// holding the drain open until --idle-timeout
+		for _, s := range servers {
+			s.SetKeepAlivesEnabled(false)
+		}
+		for _, s := range servers {
+			if err := s.Shutdown(ctx); err != nil {
+				errorf("Server shutdown error: %v", err)
+			}
+		}
+		for _, s := range h3Servers {
+			if err := s.Shutdown(ctx); err != nil {
+				errorf("HTTP/3 server shutdown error: %v", err)
+			}
 		}
+		active.logRemaining()
 	}()
 
+	// Bind every address before serving any, so a bad one fails fast
+	listeners, err := bindListeners(config)
+	if err != nil {
+		return err
+	}
+	if config.MaxConnections > 0 {
+		limiter := newConnLimiter(config.MaxConnections)
+		for i, listener := range listeners {
+			listeners[i] = limiter.wrap(listener)
+		}
+	}
+	h3Conns, err := bindHTTP3(h3Servers)
+	if err != nil {
+		return err
+	}
+	for i, s := range h3Servers {
+		go func() {
+			infof("Serving HTTP/3 on udp %s", s.Addr)
+			if err := s.Serve(h3Conns[i]); err != http.ErrServerClosed {
+				fail(fmt.Errorf("HTTP/3 server: %w", err))
+			}
+		}()
+	}
+
 	// Start the server
-	log.Printf("Starting reverse proxy on %s:%d -> %s:%d",
-		config.Host, config.Port, config.ProxyHost, config.ProxyPort)
+	serveErr := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		infof("Starting reverse proxy on %s -> %s", listenerName(listener), settings.pool)
+		go func() {
+			// Without a TLS config serve plain HTTP
+			if tlsConfig == nil {
+				serveErr <- server.Serve(listener)
+				return
+			}
+			serveErr <- server.ServeTLS(listener, "", "")
+		}()
+	}
+	for range listeners {
+		select {
+		case err := <-serveErr:
+			if err != http.ErrServerClosed {
+				return err
+			}
+		case err := <-failed:
+			return err
+		}
+	}
 
-	if err := server.ListenAndServeTLS(config.CertFile, config.KeyFile); err != http.ErrServerClosed {
-		log.Fatal(err)
+	// Serve returns as soon as shutdown begins, so wait for in-flight
+	// requests to drain before exiting
+	<-shutdownDone
+
+	if shutdownTracing != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			errorf("Trace export error: %v", err)
+		}
 	}
-}
\ No newline at end of file
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// pickedPortPattern matches the log line bindListeners writes for --port 0.
+var pickedPortPattern = regexp.MustCompile(`Listening on port (\d+) picked by the OS`)
+
+// portWatcher is a log output that reports the port the relay picked.
+type portWatcher chan int
+
+func (w portWatcher) Write(p []byte) (int, error) {
+	if m := pickedPortPattern.FindSubmatch(p); m != nil {
+		port, _ := strconv.Atoi(string(m[1]))
+		select {
+		case w <- port:
+		default:
+		}
+	}
+	return len(p), nil
+}
+
+func TestRunProxiesOnEphemeralPort(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "backend saw "+r.URL.Path)
+	}))
+	defer backend.Close()
+
+	picked := make(portWatcher, 1)
+	log.SetOutput(picked)
+	defer log.SetOutput(os.Stderr)
+
+	config := testConfig(t, backendFlags(t, backend.URL)...)
+	done := make(chan error, 1)
+	go func() { done <- run(config, nil) }()
+
+	var relay string
+	select {
+	case p := <-picked:
+		relay = "http://127.0.0.1:" + strconv.Itoa(p)
+	case err := <-done:
+		t.Fatalf("run returned before listening: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay did not report the port it picked")
+	}
+
+	for _, tc := range []struct {
+		path, want string
+	}{
+		{"/hello", "backend saw /hello"},
+		{"/healthz", `{"status":"ok"}` + "\n"},
+	} {
+		resp, err := http.Get(relay + tc.path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", tc.path, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != tc.want {
+			t.Errorf("GET %s = %d %q, want 200 %q", tc.path, resp.StatusCode, body, tc.want)
+		}
+	}
+
+	// run shuts down gracefully on SIGTERM, which it has registered for
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("run returned %v after SIGTERM", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("run did not return after SIGTERM")
+	}
+}
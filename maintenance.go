@@ -0,0 +1,78 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// defaultMaintenancePage is served in maintenance mode when
+// --maintenance-page is not set.
+const defaultMaintenancePage = `<!DOCTYPE html>
+<html>
+<head><title>Down for maintenance</title></head>
+<body>
+<h1>Down for maintenance</h1>
+<p>This service is undergoing planned maintenance. Please try again later.</p>
+<p><small>Request ID: {{.RequestID}}</small></p>
+</body>
+</html>
+`
+
+// maintenanceMode answers every proxied request with 503 while it is on,
+// so the backends can be taken down while the relay stays reachable. The
+// relay's own endpoints keep working, which is how it is switched off again.
+type maintenanceMode struct {
+	on         atomic.Bool
+	page       *errorPage
+	retryAfter string
+}
+
+// newMaintenanceMode loads the page served during maintenance, from path or
+// the default page if path is empty. A positive retryAfter is sent to
+// clients as Retry-After.
+func newMaintenanceMode(path string, retryAfter time.Duration) (*maintenanceMode, error) {
+	page, err := loadErrorPage("maintenance page", path, defaultMaintenancePage)
+	if err != nil {
+		return nil, err
+	}
+	m := &maintenanceMode{page: page}
+	if retryAfter > 0 {
+		m.retryAfter = strconv.Itoa(int(math.Ceil(retryAfter.Seconds())))
+	}
+	return m, nil
+}
+
+// set switches maintenance mode on or off, logging the change.
+func (m *maintenanceMode) set(on bool) {
+	if m.on.Swap(on) == on {
+		return
+	}
+	if on {
+		warnf("Maintenance mode on: answering proxied requests with 503")
+	} else {
+		infof("Maintenance mode off: proxying requests again")
+	}
+}
+
+// toggle flips maintenance mode, as SIGUSR1 does.
+func (m *maintenanceMode) toggle() {
+	m.set(!m.on.Load())
+}
+
+// middleware short-circuits requests to next with the maintenance page
+// while maintenance mode is on.
+func (m *maintenanceMode) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !m.on.Load() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if m.retryAfter != "" {
+			w.Header().Set("Retry-After", m.retryAfter)
+		}
+		m.page.write(w, r, http.StatusServiceUnavailable)
+	})
+}
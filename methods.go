@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// methodFilter answers 405 to requests whose method is not on the allow
+// list, naming the allowed methods in the Allow header.
+type methodFilter struct {
+	allowed map[string]bool
+	header  string
+}
+
+// newMethodFilter builds a filter from method names, which are matched
+// case-sensitively after being upper-cased here.
+func newMethodFilter(methods []string) (*methodFilter, error) {
+	f := &methodFilter{allowed: map[string]bool{}}
+	var names []string
+	for _, method := range methods {
+		method = strings.ToUpper(strings.TrimSpace(method))
+		if method == "" || strings.IndexFunc(method, func(r rune) bool { return !httpguts.IsTokenRune(r) }) >= 0 {
+			return nil, fmt.Errorf("invalid method %q", method)
+		}
+		if !f.allowed[method] {
+			f.allowed[method] = true
+			names = append(names, method)
+		}
+	}
+	f.header = strings.Join(names, ", ")
+	return f, nil
+}
+
+func (f *methodFilter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !f.allowed[r.Method] {
+			w.Header().Set("Allow", f.header)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
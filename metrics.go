@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// relayMetrics holds the Prometheus collectors for proxied traffic.
+type relayMetrics struct {
+	registry *prometheus.Registry
+	requests *prometheus.CounterVec
+	latency  *prometheus.HistogramVec
+	up       *prometheus.GaugeVec
+	draining *prometheus.GaugeVec
+	expiry   *prometheus.GaugeVec
+}
+
+func newRelayMetrics() *relayMetrics {
+	m := &relayMetrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "jnbrelay_upstream_requests_total",
+			Help: "Requests forwarded to a backend, by backend and response status code.",
+		}, []string{"backend", "code"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "jnbrelay_upstream_request_duration_seconds",
+			Help:    "Time until a backend returned response headers.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"backend"}),
+		up: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "jnbrelay_backend_up",
+			Help: "Whether health checks consider a backend up (1) or down (0).",
+		}, []string{"backend"}),
+		draining: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "jnbrelay_backend_draining",
+			Help: "Whether a backend was drained through the admin API (1) or not (0).",
+		}, []string{"backend"}),
+		expiry: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "jnbrelay_certificate_days_until_expiry",
+			Help: "Days until a certificate loaded from disk expires, negative once it has.",
+		}, []string{"certificate"}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests,
+		m.latency,
+		m.up,
+		m.draining,
+		m.expiry,
+	)
+
+	return m
+}
+
+// handler serves the metrics in the Prometheus exposition format.
+func (m *relayMetrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// setBackendUp records the health check state of backend.
+func (m *relayMetrics) setBackendUp(backend string, up bool) {
+	value := 0.0
+	if up {
+		value = 1
+	}
+	m.up.WithLabelValues(backend).Set(value)
+}
+
+// setBackendDraining records whether backend is draining.
+func (m *relayMetrics) setBackendDraining(backend string, draining bool) {
+	value := 0.0
+	if draining {
+		value = 1
+	}
+	m.draining.WithLabelValues(backend).Set(value)
+}
+
+// setCertExpiry records how long until the certificate at path expires.
+func (m *relayMetrics) setCertExpiry(path string, remaining time.Duration) {
+	m.expiry.WithLabelValues(path).Set(remaining.Hours() / 24)
+}
+
+// wrap returns a RoundTripper that records every upstream round trip before
+// handing it to next. Failed round trips are counted with the code "error".
+func (m *relayMetrics) wrap(next http.RoundTripper) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		start := time.Now()
+		resp, err := next.RoundTrip(req)
+
+		backend := req.URL.Host
+		m.latency.WithLabelValues(backend).Observe(time.Since(start).Seconds())
+
+		code := "error"
+		if err == nil {
+			code = strconv.Itoa(resp.StatusCode)
+		}
+		m.requests.WithLabelValues(backend, code).Inc()
+
+		return resp, err
+	})
+}
+
+// roundTripperFunc adapts an ordinary function to the http.RoundTripper
+// interface.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
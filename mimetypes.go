@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"path/filepath"
+)
+
+// registerMimeTypes adds custom extension to content type mappings so that
+// mime.TypeByExtension, and with it fixMimeType, picks them up.
+func registerMimeTypes(types map[string]string) error {
+	for ext, mimeType := range types {
+		if _, _, err := mime.ParseMediaType(mimeType); err != nil {
+			return fmt.Errorf("invalid MIME type %q for %s: %v", mimeType, ext, err)
+		}
+		if err := mime.AddExtensionType(ext, mimeType); err != nil {
+			return fmt.Errorf("cannot register MIME type for %s: %v", ext, err)
+		}
+	}
+	return nil
+}
+
+// fixMimeType sets the Content-Type header from the file extension of the
+// request path. Unless force is set, only empty or generic types are
+// replaced.
+func fixMimeType(resp *http.Response, force bool) {
+	// Get the request path
+	path := resp.Request.URL.Path
+
+	// Detect MIME type from file extension
+	ext := filepath.Ext(path)
+	if ext == "" {
+		return
+	}
+	correctMimeType := mime.TypeByExtension(ext)
+
+	// If we detected a MIME type, update the Content-Type header
+	if correctMimeType == "" {
+		return
+	}
+	currentContentType := resp.Header.Get("Content-Type")
+
+	// Only override if the current type is wrong or generic
+	if currentContentType == "" ||
+		currentContentType == "text/plain" ||
+		currentContentType == "application/octet-stream" ||
+		(force && mediaType(currentContentType) != mediaType(correctMimeType)) {
+		resp.Header.Set("Content-Type", correctMimeType)
+		debugf("Fixed MIME type of %s from %q to %q", path, currentContentType, correctMimeType)
+	}
+}
+
+// mediaType strips parameters such as charset from a content type.
+func mediaType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return contentType
+	}
+	return mediaType
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// maxMirrorBody is the largest request body copied to the mirror;
+	// requests with larger bodies are not mirrored.
+	maxMirrorBody = 1 << 20
+	// maxMirrorInFlight caps the mirror requests outstanding at once, so a
+	// slow mirror cannot pile up goroutines and buffered bodies.
+	maxMirrorInFlight = 64
+	// mirrorTimeout bounds each mirror request.
+	mirrorTimeout = 30 * time.Second
+)
+
+// requestMirror sends a copy of a share of the requests that reach the
+// backends to a shadow backend and throws its responses away. Copies are
+// sent in the background once the primary request body has been read, and
+// nothing about them reaches the client.
+type requestMirror struct {
+	pool      *backendPool
+	percent   float64
+	transport http.RoundTripper
+	inFlight  chan struct{}
+}
+
+func newRequestMirror(pool *backendPool, percent float64, transport http.RoundTripper) *requestMirror {
+	return &requestMirror{
+		pool:      pool,
+		percent:   percent,
+		transport: transport,
+		inFlight:  make(chan struct{}, maxMirrorInFlight),
+	}
+}
+
+// wrap returns a RoundTripper that mirrors requests sent through next. The
+// copy is taken after the director ran, so the mirror sees the same path
+// and headers as the primary backend.
+func (m *requestMirror) wrap(next http.RoundTripper) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		// Upgraded connections cannot be replayed
+		if req.Header.Get("Upgrade") != "" || rand.Float64()*100 >= m.percent {
+			return next.RoundTrip(req)
+		}
+
+		shadow := req.Clone(context.Background())
+		if req.Body == nil || req.Body == http.NoBody {
+			m.send(shadow, nil)
+			return next.RoundTrip(req)
+		}
+		req.Body = &mirrorBody{ReadCloser: req.Body, done: func(body []byte) {
+			m.send(shadow, body)
+		}}
+		return next.RoundTrip(req)
+	})
+}
+
+// send delivers shadow to the mirror in the background, unless too many
+// mirror requests are outstanding already.
+func (m *requestMirror) send(shadow *http.Request, body []byte) {
+	select {
+	case m.inFlight <- struct{}{}:
+	default:
+		debugf("Mirror busy, skipping %s %s", shadow.Method, shadow.URL.Path)
+		return
+	}
+
+	go func() {
+		defer func() { <-m.inFlight }()
+
+		ctx, cancel := context.WithTimeout(context.Background(), mirrorTimeout)
+		defer cancel()
+		shadow = shadow.WithContext(ctx)
+		target := m.pool.pick().url
+		shadow.URL.Scheme = target.Scheme
+		shadow.URL.Host = target.Host
+		shadow.Host = target.Host
+		shadow.Body = io.NopCloser(bytes.NewReader(body))
+		shadow.ContentLength = int64(len(body))
+		shadow.GetBody = nil
+		if body == nil {
+			shadow.Body = nil
+		}
+
+		resp, err := m.transport.RoundTrip(shadow)
+		if err != nil {
+			debugf("Mirror request to %s failed: %v", target.Host, err)
+			return
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+}
+
+// mirrorBody copies a request body as the primary transport reads it and
+// hands the copy to done once the body was read in full. Bodies that are
+// larger than maxMirrorBody, or not read to the end, are not passed on. The
+// transport may close the body while another goroutine reads it, hence the
+// lock.
+type mirrorBody struct {
+	io.ReadCloser
+	done func(body []byte)
+
+	mu       sync.Mutex
+	buf      bytes.Buffer
+	tooLarge bool
+	finished bool
+}
+
+func (b *mirrorBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.finished {
+		return n, err
+	}
+	if !b.tooLarge && b.buf.Len()+n > maxMirrorBody {
+		b.tooLarge = true
+		b.buf = bytes.Buffer{}
+	}
+	if !b.tooLarge {
+		b.buf.Write(p[:n])
+	}
+	if err == io.EOF {
+		b.finished = true
+		if !b.tooLarge {
+			b.done(b.buf.Bytes())
+		}
+	}
+	return n, err
+}
+
+func (b *mirrorBody) Close() error {
+	b.mu.Lock()
+	b.finished = true
+	b.mu.Unlock()
+	return b.ReadCloser.Close()
+}
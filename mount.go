@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// mountPath is the path prefix the relay is hosted under on a shared
+// hostname, without a trailing slash, e.g. "/service". Requests arrive with
+// the prefix and are forwarded without it.
+type mountPath string
+
+func newMountPath(path string) mountPath {
+	return mountPath(normalizePrefix(path))
+}
+
+// middleware answers 404 for paths outside the mount instead of forwarding
+// them.
+func (m mountPath) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !hasPathPrefix(r.URL.Path, string(m)) {
+			http.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// strip removes the mount from the outgoing request path.
+func (m mountPath) strip(u *url.URL) {
+	rt := &route{stripPrefix: string(m)}
+	rt.rewritePath(u)
+}
+
+// rewriteLocation puts the mount back in front of redirects the backend
+// sends to its own paths. Absolute paths and absolute URLs pointing at the
+// backend or the relay are rewritten; relative references already resolve
+// under the mount, and redirects to other hosts are left alone.
+func (m mountPath) rewriteLocation(resp *http.Response) {
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return
+	}
+
+	location := resp.Header.Get("Location")
+	u, err := url.Parse(location)
+	if location == "" || err != nil {
+		return
+	}
+	if u.Host != "" && !strings.EqualFold(u.Host, resp.Request.Host) &&
+		!strings.EqualFold(u.Host, publicOriginOf(resp.Request).host) {
+		return
+	}
+	if u.Host == "" && !strings.HasPrefix(u.Path, "/") {
+		return
+	}
+
+	u.Path = string(m) + ensureLeadingSlash(u.Path)
+	if u.RawPath != "" {
+		u.RawPath = string(m) + ensureLeadingSlash(u.RawPath)
+	}
+	resp.Header.Set("Location", u.String())
+}
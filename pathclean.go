@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"strings"
+)
+
+// pathNormalizations are the accepted --path-normalization modes.
+var pathNormalizations = map[string]bool{"strict": true, "clean": true, "off": true}
+
+// normalizePaths cleans request paths before they are routed and forwarded,
+// so a backend never sees "." or ".." segments or repeated slashes, however
+// they were encoded. Null bytes get 400 in every mode but "off". In "strict"
+// mode ".." segments get 400 as well; "clean" resolves them instead.
+func normalizePaths(mode string, next http.Handler) http.Handler {
+	if mode == "off" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := r.URL.Path
+		if strings.ContainsRune(p, 0) || (mode == "strict" && hasDotDotSegment(p)) {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if cleaned := cleanPath(p); cleaned != p {
+			// The escaped form may hide the segments just removed, so it
+			// is rebuilt from the cleaned path
+			r.URL.Path = cleaned
+			r.URL.RawPath = ""
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// cleanPath applies path.Clean but keeps a trailing slash, which backends
+// often treat differently from its absence. Paths that are not absolute,
+// such as "*", are left alone.
+func cleanPath(p string) string {
+	if !strings.HasPrefix(p, "/") {
+		return p
+	}
+	cleaned := path.Clean(p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// hasDotDotSegment reports whether the decoded path has a ".." segment.
+func hasDotDotSegment(p string) bool {
+	for _, segment := range strings.Split(p, "/") {
+		if segment == ".." {
+			return true
+		}
+	}
+	return false
+}
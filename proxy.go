@@ -0,0 +1,240 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"sync/atomic"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// newProxy returns the reverse proxy that forwards requests to the backends.
+// It picks a backend of the matching domain or route for every request,
+// adjusts responses on their way back, and answers with errorPages once a
+// backend cannot be reached. Requests go out through transport, wrapped in
+// the timeouts, retries and other layers the config enables. Responses are
+// stored in cache if it is not nil.
+func newProxy(config *Config, transport http.RoundTripper, live *atomic.Pointer[liveSettings], domains *domainRouter, metrics *relayMetrics, cache *responseCache, errorPages *errorPage) (*httputil.ReverseProxy, error) {
+	proxy := &httputil.ReverseProxy{FlushInterval: config.FlushInterval}
+	if config.BufferSize > 0 {
+		proxy.BufferPool = newBufferPool(config.BufferSize)
+	}
+
+	// Customize the director, picking the next backend of the matching route
+	// for every request. A domain with backends of its own takes precedence;
+	// otherwise routes match the path below --mount-path.
+	mount := newMountPath(config.MountPath)
+	forwarded := forwardedHeaders{
+		host:   config.ForwardedHostHeader,
+		proto:  config.ForwardedProtoHeader,
+		realIP: config.RealIPHeader,
+	}
+	var sticky *stickySessions
+	if config.StickySessions {
+		sticky = newStickySessions(config.StickyCookieName, config.StickyCookieTTL, mount)
+	}
+	proxy.Director = func(req *http.Request) {
+		if mount != "" {
+			mount.strip(req.URL)
+		}
+
+		// Capture how the client reached the relay before the URL is
+		// pointed at the backend
+		origin := publicOriginOf(req)
+
+		settings := live.Load()
+		rt := domains.match(req.Host)
+		if rt == nil {
+			rt = settings.routes.match(req.URL.Path)
+		}
+		rt.rewritePath(req.URL)
+		// Let the timeout and retry transports find the route's overrides
+		setRoute(req, rt)
+
+		pool := rt.pool
+		if settings.canary != nil && pool == settings.pool && toCanary(req, settings.canaryPercent) {
+			pool = settings.canary
+		}
+		var b *backend
+		if sticky != nil {
+			b = sticky.pick(req, pool)
+		} else {
+			b = pool.pick()
+		}
+		req.URL.Scheme = b.url.Scheme
+		req.URL.Host = b.url.Host
+		req.Host = b.hostHeader()
+
+		// Add standard proxy headers, unless a proxy in front of the relay
+		// already sets them
+		if !config.OmitForwardedHeaders {
+			forwarded.set(req, origin.host, origin.scheme)
+			prepareForwardedFor(req, config.TrustForwardedFor || viaTrustedProxy(req))
+		}
+
+		if config.ClientCAFile != "" {
+			setClientCertHeader(req)
+		}
+
+		settings.requestHeaders.apply(req.Header)
+
+		// X-Request-ID was assigned by withRequestID and is forwarded as is
+	}
+
+	var rewriter *bodyRewriter
+	if len(config.RewriteBody) > 0 {
+		var err error
+		rewriter, err = newBodyRewriter(config.RewriteBody, config.MaxBufferedBody)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	remap, err := newStatusRemap(config.RemapStatus)
+	if err != nil {
+		return nil, err
+	}
+
+	var security *securityHeaders
+	if config.SecurityHeaders {
+		security = newSecurityHeaders(config.HSTSMaxAge, config.SecurityHeadersOverride)
+	}
+
+	// Adjust responses on their way back to the client
+	staticExtensions := newExtensionSet(config.StaticExtensions)
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		// Leave protocol upgrades such as WebSockets untouched
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			return nil
+		}
+
+		// withRequestID already echoes the ID to the client; drop the
+		// backend's copy so it is neither duplicated nor cached
+		resp.Header.Del(requestIDHeader)
+
+		// Normalize backend statuses before anything acts on them
+		remap.apply(resp)
+
+		grpc := isGRPC(resp.Header.Get("Content-Type"))
+		if isEventStream(resp) || grpc {
+			extendStream(resp)
+		}
+
+		// Add the mount first, while absolute redirects still name the
+		// backend, then point them at the relay
+		if mount != "" {
+			mount.rewriteLocation(resp)
+		}
+		rewriteBackendLocation(resp)
+
+		// Security headers go first so --remove-response-header can drop one
+		if security != nil {
+			security.apply(resp.Header)
+		}
+		if sticky != nil {
+			sticky.setCookie(resp)
+		}
+		if config.AltSvc != "" {
+			resp.Header.Set("Alt-Svc", config.AltSvc)
+		}
+		live.Load().responseHeaders.apply(resp.Header)
+
+		// gRPC frames its own messages and reports the call's status in
+		// trailers, so its body and type go to the client as they are
+		if grpc {
+			return nil
+		}
+
+		// Let browsers cache static assets the backend left uncached
+		if config.StaticCacheControl != "" &&
+			staticExtensions.matches(resp.Request.URL.Path) &&
+			resp.Header.Get("Cache-Control") == "" {
+			resp.Header.Set("Cache-Control", config.StaticCacheControl)
+		}
+
+		// Fix MIME types based on file extension
+		fixMimeType(resp, config.ForceMimeOverride)
+
+		// Rewrite before compressing, while the body is still plain text
+		if rewriter != nil {
+			if err := rewriter.apply(resp); err != nil {
+				return err
+			}
+		}
+
+		if config.Compress {
+			compressResponse(resp, config.CompressMinSize)
+		}
+
+		// Capture last so the cache stores exactly what the client receives
+		if cache != nil {
+			cache.capture(resp)
+		}
+
+		return nil
+	}
+
+	proxy.Transport, err = newUpstreamTransport(config, transport, metrics)
+	if err != nil {
+		return nil, err
+	}
+
+	// Add error handling, reached once any retries are exhausted
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		status, category := classifyProxyError(err)
+		// Backends that are slow or clients that gave up are worth a
+		// warning; anything else means the backend is failing
+		switch {
+		case status == http.StatusGatewayTimeout || category == "client canceled":
+			warnf("Proxy error (%s): %v", category, err)
+		case status == http.StatusBadGateway:
+			errorf("Proxy error (%s): %v", category, err)
+		}
+		errorPages.write(w, r, status)
+	}
+
+	return proxy, nil
+}
+
+// newUpstreamTransport wraps transport in the timeouts, retries, circuit
+// breaker, mirror and instrumentation the config enables.
+func newUpstreamTransport(config *Config, transport http.RoundTripper, metrics *relayMetrics) (http.RoundTripper, error) {
+	// With tracing, every attempt gets a client span that carries the trace
+	// context to the backend
+	if config.OTLPEndpoint != "" {
+		transport = otelhttp.NewTransport(transport)
+	}
+	// Routes can override the timeout and retries, also after a reload, so
+	// both transports stay in place even when the global settings are off
+	transport = newTimeoutTransport(transport, config.UpstreamTimeout)
+	// Record upstream metrics if enabled
+	if metrics != nil {
+		transport = metrics.wrap(transport)
+	}
+
+	// Retry failed attempts before the error handler sees them. Metrics are
+	// recorded per attempt, underneath the retries.
+	transport = newRetryTransport(transport, config.RetryAttempts, config.RetryBackoff)
+
+	// Stop sending requests to a failing backend. The breaker sits outside
+	// the retries so each client request counts once.
+	if config.CircuitFailureThreshold > 0 {
+		transport = newCircuitBreaker(config.CircuitFailureThreshold, config.CircuitResetTimeout).wrap(transport)
+	}
+
+	// Copy a share of the requests to the mirror, as the director rewrote
+	// them, over connections of its own
+	if config.MirrorBackend != "" {
+		mirrorPool, err := newBackendPool(config.MirrorBackend, config.ProxyPort, backendScheme(config))
+		if err != nil {
+			return nil, err
+		}
+		mirrorTransport, err := newTransport(config)
+		if err != nil {
+			return nil, err
+		}
+		transport = newRequestMirror(mirrorPool, config.MirrorPercent, mirrorTransport).wrap(transport)
+		infof("Mirroring %g%% of requests to %s", config.MirrorPercent, mirrorPool)
+	}
+	return transport, nil
+}
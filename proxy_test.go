@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// testConfig builds a plain HTTP config through mergeConfig, the way the
+// command line does, with args added to the required flags.
+func testConfig(t *testing.T, args ...string) *Config {
+	t.Helper()
+	args = append([]string{"--host", "127.0.0.1", "--port", "0", "--no-tls"}, args...)
+	config, err := mergeConfig("", args)
+	if err != nil {
+		t.Fatalf("mergeConfig(%q): %v", args, err)
+	}
+	return config
+}
+
+// backendFlags returns the flags that point the relay at the test server
+// listening on rawURL.
+func backendFlags(t *testing.T, rawURL string) []string {
+	t.Helper()
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []string{"--proxy-for-host", host, "--proxy-for-port", port}
+}
+
+// testProxy returns the proxy for config, sending requests through
+// transport, with the per-request state run sets up in front of it.
+func testProxy(t *testing.T, config *Config, transport http.RoundTripper) http.Handler {
+	t.Helper()
+	domains, err := newDomainRouter(config.Domains, config.ProxyPort, backendScheme(config), config.StripPrefix, config.StrictCertValidity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var live atomic.Pointer[liveSettings]
+	settings, err := newLiveSettings(config, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	live.Store(settings)
+	errorPages, err := newErrorPage("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := newProxy(config, transport, &live, domains, nil, nil, errorPages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return withPublicOrigin(config.PublicHost, withResponseController(withRouteSlot(proxy)))
+}
+
+func TestProxyUsesGivenTransport(t *testing.T) {
+	var got *http.Request
+	fake := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		got = req
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {"text/plain"}},
+			Body:       io.NopCloser(strings.NewReader("from fake")),
+			Request:    req,
+		}, nil
+	})
+	config := testConfig(t, "--proxy-for-host", "backend.test", "--proxy-for-port", "8080")
+	proxy := testProxy(t, config, fake)
+
+	req := httptest.NewRequest(http.MethodGet, "http://relay.test/hello?x=1", nil)
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, req)
+
+	if got == nil {
+		t.Fatal("fake transport was not called")
+	}
+	if got.URL.String() != "http://backend.test:8080/hello?x=1" {
+		t.Errorf("backend URL = %s, want http://backend.test:8080/hello?x=1", got.URL)
+	}
+	if got.Header.Get("X-Forwarded-Host") != "relay.test" {
+		t.Errorf("X-Forwarded-Host = %q, want relay.test", got.Header.Get("X-Forwarded-Host"))
+	}
+	if rec.Code != http.StatusOK || rec.Body.String() != "from fake" {
+		t.Errorf("response = %d %q, want 200 \"from fake\"", rec.Code, rec.Body.String())
+	}
+}
+
+func TestProxyErrorFromTransport(t *testing.T) {
+	fake := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return nil, io.ErrUnexpectedEOF
+	})
+	config := testConfig(t, "--proxy-for-host", "backend.test", "--proxy-for-port", "8080", "--retry-attempts", "0")
+	proxy := testProxy(t, config, fake)
+
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://relay.test/", nil))
+
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusBadGateway)
+	}
+}
+
+// writeClientFrame sends payload as a single masked text frame, as
+// WebSocket clients must.
+func writeClientFrame(w io.Writer, payload string) error {
+	frame := []byte{0x81, 0x80 | byte(len(payload)), 0, 0, 0, 0}
+	mask := frame[2:6]
+	if _, err := rand.Read(mask); err != nil {
+		return err
+	}
+	for i := 0; i < len(payload); i++ {
+		frame = append(frame, payload[i]^mask[i%4])
+	}
+	_, err := w.Write(frame)
+	return err
+}
+
+// readServerFrame reads a short unmasked text frame, as WebSocket servers
+// send them.
+func readServerFrame(r io.Reader) (string, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return "", err
+	}
+	if head[0] != 0x81 || head[1]&0x80 != 0 || head[1] >= 126 {
+		return "", fmt.Errorf("unexpected frame header %x", head)
+	}
+	payload := make([]byte, head[1])
+	_, err := io.ReadFull(r, payload)
+	return string(payload), err
+}
+
+func TestProxyWebSocketUpgrade(t *testing.T) {
+	backend := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		if err := websocket.Message.Send(ws, "hello from backend"); err != nil {
+			return
+		}
+		var msg string
+		for websocket.Message.Receive(ws, &msg) == nil {
+			websocket.Message.Send(ws, "echo: "+msg)
+		}
+	}))
+	defer backend.Close()
+
+	config := testConfig(t, backendFlags(t, backend.URL)...)
+	transport, err := newTransport(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay := httptest.NewServer(testProxy(t, config, transport))
+	defer relay.Close()
+
+	conn, err := net.Dial("tcp", relay.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	req, err := http.NewRequest(http.MethodGet, relay.URL+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Origin", relay.URL)
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Sec-WebSocket-Accept = %q, want the backend's answer to the key", got)
+	}
+
+	// The backend speaks first, then echoes what the client sends
+	if msg, err := readServerFrame(br); err != nil || msg != "hello from backend" {
+		t.Fatalf("first frame = %q, %v; want \"hello from backend\"", msg, err)
+	}
+	if err := writeClientFrame(conn, "ping"); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := readServerFrame(br); err != nil || msg != "echo: ping" {
+		t.Fatalf("echoed frame = %q, %v; want \"echo: ping\"", msg, err)
+	}
+}
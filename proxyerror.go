@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"syscall"
+)
+
+// classifyProxyError picks the status for a request the proxy could not
+// complete, along with a short category for the log: 504 when the backend
+// timed out and 502 when it could not be reached or dropped the connection,
+// unless a relay limit refused the request first.
+func classifyProxyError(err error) (int, string) {
+	var tooLarge *http.MaxBytesError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errCircuitOpen):
+		return http.StatusServiceUnavailable, "circuit open"
+	case errors.As(err, &tooLarge):
+		return http.StatusRequestEntityTooLarge, "request body too large"
+	case errors.Is(err, context.Canceled):
+		return http.StatusBadGateway, "client canceled"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return http.StatusGatewayTimeout, "backend timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return http.StatusBadGateway, "connection refused"
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return http.StatusBadGateway, "connection reset"
+	default:
+		return http.StatusBadGateway, "backend error"
+	}
+}
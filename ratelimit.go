@@ -0,0 +1,90 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// clientLimiter tracks a token bucket per client IP.
+type clientLimiter struct {
+	limit rate.Limit
+	burst int
+
+	mu      sync.Mutex
+	clients map[string]*clientBucket
+}
+
+type clientBucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// newClientLimiter allows perSecond requests per client. A burst of 0
+// defaults to the rate rounded up.
+func newClientLimiter(perSecond float64, burst int) *clientLimiter {
+	if burst == 0 {
+		burst = int(math.Ceil(perSecond))
+	}
+	return &clientLimiter{
+		limit:   rate.Limit(perSecond),
+		burst:   burst,
+		clients: map[string]*clientBucket{},
+	}
+}
+
+// allow takes a token from the client's bucket. When the bucket is empty it
+// rejects the request with 429 and returns false.
+func (l *clientLimiter) allow(w http.ResponseWriter, r *http.Request) bool {
+	reservation := l.bucket(clientIP(r)).Reserve()
+	if delay := reservation.Delay(); delay > 0 {
+		reservation.Cancel()
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
+
+func (l *clientLimiter) bucket(ip string) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.clients[ip]
+	if !ok {
+		b = &clientBucket{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.clients[ip] = b
+	}
+	b.lastSeen = time.Now()
+	return b.limiter
+}
+
+// evictIdle periodically forgets clients not seen for idleAfter, keeping the
+// map from growing without bound. A forgotten client starts again with a
+// full bucket, which is what it would have refilled to by then anyway.
+// It returns once done is closed.
+func (l *clientLimiter) evictIdle(interval, idleAfter time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		cutoff := time.Now().Add(-idleAfter)
+		l.mu.Lock()
+		for ip, b := range l.clients {
+			if b.lastSeen.Before(cutoff) {
+				delete(l.clients, ip)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
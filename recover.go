@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"runtime/debug"
+)
+
+// recoverPanics turns a panic in next into a log entry and a 500 response,
+// where net/http would otherwise drop the connection. If the response has
+// already started, the connection is aborted instead. logStack adds the
+// stack trace to the log entry.
+func recoverPanics(logStack bool, errorPages *errorPage, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			// The reverse proxy panics with ErrAbortHandler to cut off a
+			// response it cannot finish; net/http handles that quietly
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+
+			if logStack {
+				errorf("Panic serving %s %s: %v\n%s", r.Method, r.URL.Path, err, debug.Stack())
+			} else {
+				errorf("Panic serving %s %s: %v", r.Method, r.URL.Path, err)
+			}
+
+			if rec.status != 0 {
+				panic(http.ErrAbortHandler)
+			}
+			// Drop headers meant for the response that failed, keeping only
+			// the request ID
+			id := w.Header().Get(requestIDHeader)
+			clear(w.Header())
+			w.Header().Set(requestIDHeader, id)
+			errorPages.write(w, r, http.StatusInternalServerError)
+		}()
+
+		next.ServeHTTP(rec, r)
+	})
+}
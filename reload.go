@@ -0,0 +1,236 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// liveSettings are the parts of the configuration that a reload can change
+// while the relay keeps running.
+type liveSettings struct {
+	// pool holds the default backends, which routes fall back to
+	pool            *backendPool
+	routes          *router
+	requestHeaders  *headerRules
+	responseHeaders *headerRules
+
+	// canary, when set, takes canaryPercent of the requests for pool
+	canary        *backendPool
+	canaryPercent float64
+
+	// limiter is nil when rate limiting is off
+	limiter   *clientLimiter
+	rateLimit float64
+	rateBurst int
+	stopEvict chan struct{}
+
+	// stopChecks ends the health checks of the backends, if any
+	stopChecks func()
+}
+
+// liveConfigFields are the Config fields covered by liveSettings. Any other
+// field needs a restart to change.
+var liveConfigFields = map[string]bool{
+	"ProxyHost":             true,
+	"ProxyPort":             true,
+	"CanaryBackend":         true,
+	"CanaryPercent":         true,
+	"Routes":                true,
+	"StripPrefix":           true,
+	"AddRequestHeaders":     true,
+	"RemoveRequestHeaders":  true,
+	"AddResponseHeaders":    true,
+	"RemoveResponseHeaders": true,
+	"RateLimit":             true,
+	"RateBurst":             true,
+}
+
+// newLiveSettings builds the live settings from config. The default and
+// canary backends carry over from prev when they are unchanged, keeping
+// their rotation and health state, and so do the rate limiter and with it
+// every client's bucket. With a checker, the backends are health checked
+// until the settings are retired.
+func newLiveSettings(config *Config, prev *liveSettings, checker *healthChecker) (*liveSettings, error) {
+	pool, err := newUpstreamPool(config)
+	if err != nil {
+		return nil, err
+	}
+	if prev != nil && prev.pool.sameBackends(pool) {
+		pool = prev.pool
+	}
+	var canary *backendPool
+	if config.CanaryBackend != "" {
+		canary, err = newBackendPool(config.CanaryBackend, config.ProxyPort, backendScheme(config))
+		if err != nil {
+			return nil, err
+		}
+		if prev != nil && prev.canary != nil && prev.canary.sameBackends(canary) {
+			canary = prev.canary
+		}
+	}
+	routes, err := newRouter(config.Routes, pool, config.ProxyPort, backendScheme(config), config.StripPrefix)
+	if err != nil {
+		return nil, err
+	}
+	requestHeaders, err := newHeaderRules(config.AddRequestHeaders, config.RemoveRequestHeaders)
+	if err != nil {
+		return nil, err
+	}
+	responseHeaders, err := newHeaderRules(config.AddResponseHeaders, config.RemoveResponseHeaders)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &liveSettings{
+		pool:            pool,
+		routes:          routes,
+		canary:          canary,
+		canaryPercent:   config.CanaryPercent,
+		requestHeaders:  requestHeaders,
+		responseHeaders: responseHeaders,
+		rateLimit:       config.RateLimit,
+		rateBurst:       config.RateBurst,
+	}
+	if prev != nil && prev.rateLimit == s.rateLimit && prev.rateBurst == s.rateBurst {
+		s.limiter, s.stopEvict = prev.limiter, prev.stopEvict
+	} else if config.RateLimit > 0 {
+		s.limiter = newClientLimiter(config.RateLimit, config.RateBurst)
+		s.stopEvict = make(chan struct{})
+		go s.limiter.evictIdle(time.Minute, 3*time.Minute, s.stopEvict)
+	}
+	if prev != nil {
+		s.keepDraining(prev)
+	}
+	if checker != nil {
+		s.stopChecks = checker.watch(s.pools()...)
+	}
+	return s, nil
+}
+
+// pools returns the default backends followed by the canary's, if any, and
+// those of every route.
+func (s *liveSettings) pools() []*backendPool {
+	pools := []*backendPool{s.pool}
+	if s.canary != nil {
+		pools = append(pools, s.canary)
+	}
+	for _, rt := range s.routes.routes {
+		pools = append(pools, rt.pool)
+	}
+	return pools
+}
+
+// keepDraining carries the admin API's drains over from prev, so a reload
+// does not put a drained backend back in rotation.
+func (s *liveSettings) keepDraining(prev *liveSettings) {
+	drained := map[string]bool{}
+	for _, pool := range prev.pools() {
+		for _, b := range pool.backends {
+			if b.draining.Load() {
+				drained[b.String()] = true
+			}
+		}
+	}
+	for _, pool := range s.pools() {
+		for _, b := range pool.backends {
+			if drained[b.String()] {
+				b.draining.Store(true)
+			}
+		}
+	}
+}
+
+// retire stops work that prev no longer needs once s has replaced it.
+func (s *liveSettings) retire(prev *liveSettings) {
+	if prev.stopEvict != nil && prev.stopEvict != s.stopEvict {
+		close(prev.stopEvict)
+	}
+	if prev.stopChecks != nil {
+		prev.stopChecks()
+	}
+}
+
+// logRoutes lists the default backends when they differ from prev's, the
+// canary split, and the configured routes.
+func (s *liveSettings) logRoutes(prev *liveSettings) {
+	if prev != nil && prev.pool != s.pool {
+		infof("Proxying to %s", s.pool)
+	}
+	if s.canary != nil {
+		infof("Sending %g%% of requests for %s to canary %s", s.canaryPercent, s.pool, s.canary)
+	}
+	for _, rt := range s.routes.routes {
+		infof("Routing %s -> %s", rt.name(), rt.pool)
+	}
+}
+
+// rateLimited applies the current rate limit, if any, before next.
+func rateLimited(live *atomic.Pointer[liveSettings], next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if limiter := live.Load().limiter; limiter != nil && !limiter.allow(w, r) {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// reloadConfig re-reads the configuration the relay was started with and
+// swaps in new live settings. Requests already sent to a backend finish
+// there; new ones use the new settings. Changes to other settings are logged
+// and ignored until a restart. If the new configuration is invalid, the
+// current settings stay in place.
+func reloadConfig(running *Config, args []string, checker *healthChecker, live *atomic.Pointer[liveSettings]) {
+	config, err := mergeConfig(running.ConfigFile, args)
+	if err != nil {
+		errorf("Config reload failed, keeping the current settings: %v", err)
+		return
+	}
+	changed := restartOnlyChanges(running, config)
+
+	// The transport only knows the socket and scheme it was built with at
+	// startup, so the pools keep using them until a restart. Switching
+	// between a socket and hosts keeps the running backends altogether.
+	if config.ProxySocket != running.ProxySocket {
+		config.ProxySocket = running.ProxySocket
+		config.ProxyHost = running.ProxyHost
+		config.ProxyPort = running.ProxyPort
+	}
+	config.BackendTLS = running.BackendTLS
+
+	prev := live.Load()
+	next, err := newLiveSettings(config, prev, checker)
+	if err != nil {
+		errorf("Config reload failed, keeping the current settings: %v", err)
+		return
+	}
+
+	live.Store(next)
+	next.retire(prev)
+	if len(changed) > 0 {
+		warnf("Config reloaded; changes to %s require a restart", strings.Join(changed, ", "))
+	} else {
+		infof("Config reloaded")
+	}
+	next.logRoutes(prev)
+}
+
+// restartOnlyChanges names the settings, by config file key, that differ
+// between running and config but cannot be applied live.
+func restartOnlyChanges(running, config *Config) []string {
+	var changed []string
+	a, b := reflect.ValueOf(running).Elem(), reflect.ValueOf(config).Elem()
+	for i := 0; i < a.NumField(); i++ {
+		field := a.Type().Field(i)
+		key := field.Tag.Get("yaml")
+		if liveConfigFields[field.Name] || key == "-" {
+			continue
+		}
+		if !reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			changed = append(changed, key)
+		}
+	}
+	return changed
+}
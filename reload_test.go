@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func TestReloadKeepsRestartOnlyBackendSettings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "relay.yaml")
+	writeConfig := func(yaml string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	args := []string{"--config", path, "--host", "127.0.0.1", "--port", "0", "--no-tls"}
+
+	tests := []struct {
+		name, yaml, wantURL string
+	}{
+		{
+			name:    "host to socket",
+			yaml:    "proxySocket: /run/app.sock\nstripPrefix: /api\n",
+			wantURL: "http://127.0.0.1:8080",
+		},
+		{
+			name:    "new host with TLS",
+			yaml:    "proxyHost: 127.0.0.2\nproxyPort: 9090\nbackendTLS: true\nstripPrefix: /api\n",
+			wantURL: "http://127.0.0.2:9090",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writeConfig("proxyHost: 127.0.0.1\nproxyPort: 8080\n")
+			running, err := mergeConfig(path, args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var live atomic.Pointer[liveSettings]
+			settings, err := newLiveSettings(running, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			live.Store(settings)
+
+			writeConfig(tt.yaml)
+			reloadConfig(running, args, nil, &live)
+
+			// The live change shows the reload went through
+			if got := live.Load().routes.fallback.stripPrefix; got != "/api" {
+				t.Fatalf("stripPrefix after reload = %q, want /api", got)
+			}
+			backends := live.Load().pool.backends
+			if len(backends) != 1 {
+				t.Fatalf("got %d backends after reload, want 1", len(backends))
+			}
+			b := backends[0]
+			if b.socket != "" || b.url.String() != tt.wantURL {
+				t.Errorf("backend after reload = %s (socket %q), want %s", b.url, b.socket, tt.wantURL)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+// newRetryTransport wraps next so that requests failing to reach the backend,
+// or answered with 502 or 503, are sent again up to attempts more times.
+// Attempts are spaced by an exponential, jittered backoff starting at
+// backoff. Retries go to the backend the director picked for the request.
+// The retry attempts of the request's route, if set, replace attempts.
+func newRetryTransport(next http.RoundTripper, attempts int, backoff time.Duration) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		attempts := attempts
+		if rt := routeOf(req); rt != nil && rt.retryAttempts != nil {
+			attempts = *rt.retryAttempts
+		}
+		if attempts == 0 || !retryable(req) {
+			return next.RoundTrip(req)
+		}
+
+		for attempt := 0; ; attempt++ {
+			resp, err := next.RoundTrip(req)
+			if attempt == attempts || !upstreamFailed(resp, err) {
+				return resp, err
+			}
+			if resp != nil {
+				// Drain the body so the connection can be reused
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+
+			timer := time.NewTimer(retryDelay(backoff, attempt))
+			select {
+			case <-timer.C:
+			case <-req.Context().Done():
+				timer.Stop()
+				return nil, req.Context().Err()
+			}
+
+			if req.GetBody != nil {
+				body, err := req.GetBody()
+				if err != nil {
+					return nil, err
+				}
+				req.Body = body
+			}
+		}
+	})
+}
+
+// retryable reports whether req can safely be sent more than once: GET and
+// HEAD requests without a body, or any request whose body can be re-read.
+func retryable(req *http.Request) bool {
+	if req.GetBody != nil {
+		return true
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		return false
+	}
+	return req.Method == http.MethodGet || req.Method == http.MethodHead
+}
+
+// upstreamFailed reports whether a round trip failed to reach the backend or
+// the backend reported itself unavailable.
+func upstreamFailed(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode == http.StatusBadGateway || resp.StatusCode == http.StatusServiceUnavailable
+}
+
+// retryDelay doubles backoff for every attempt and picks a random delay
+// between half and all of it, so retries from many clients spread out.
+func retryDelay(backoff time.Duration, attempt int) time.Duration {
+	d := backoff << min(attempt, 16)
+	if d <= 1 {
+		return d
+	}
+	return d/2 + rand.N(d/2)
+}
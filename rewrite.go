@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// rewriteTypes lists the content types --rewrite-body applies to.
+var rewriteTypes = map[string]bool{
+	"text/html": true,
+	"text/css":  true,
+}
+
+// bodyRewriter replaces strings in HTML and CSS response bodies of up to
+// maxBody bytes. Larger bodies are passed through unchanged.
+type bodyRewriter struct {
+	replacer *strings.Replacer
+	maxBody  int64
+}
+
+// newBodyRewriter parses "from=>to" rules.
+func newBodyRewriter(rules []string, maxBody int64) (*bodyRewriter, error) {
+	var pairs []string
+	for _, rule := range rules {
+		from, to, ok := strings.Cut(rule, "=>")
+		if !ok || from == "" {
+			return nil, fmt.Errorf("invalid body rewrite %q, expected \"from=>to\"", rule)
+		}
+		pairs = append(pairs, from, to)
+	}
+	return &bodyRewriter{replacer: strings.NewReplacer(pairs...), maxBody: maxBody}, nil
+}
+
+// apply rewrites the body of resp if it is HTML or CSS. A gzipped body is
+// decompressed first and sent on uncompressed; other encodings are skipped.
+func (rw *bodyRewriter) apply(resp *http.Response) error {
+	if resp.Request.Method == http.MethodHead ||
+		resp.StatusCode == http.StatusNoContent ||
+		resp.StatusCode == http.StatusNotModified ||
+		resp.StatusCode == http.StatusPartialContent {
+		return nil
+	}
+	if !rewriteTypes[mediaType(resp.Header.Get("Content-Type"))] {
+		return nil
+	}
+	encoding := resp.Header.Get("Content-Encoding")
+	if encoding != "" && !strings.EqualFold(encoding, "gzip") {
+		return nil
+	}
+	if resp.ContentLength > rw.maxBody {
+		warnf("Not rewriting %s: body exceeds --max-buffered-body", resp.Request.URL.Path)
+		return nil
+	}
+
+	// Read one byte past the limit to tell whether the body fits
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, rw.maxBody+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(raw)) > rw.maxBody {
+		warnf("Not rewriting %s: body exceeds --max-buffered-body", resp.Request.URL.Path)
+		resp.Body = readCloser{io.MultiReader(bytes.NewReader(raw), resp.Body), resp.Body}
+		return nil
+	}
+	resp.Body.Close()
+
+	body := raw
+	if encoding != "" {
+		gz, err := gzip.NewReader(bytes.NewReader(raw))
+		if err == nil {
+			body, err = io.ReadAll(io.LimitReader(gz, rw.maxBody+1))
+		}
+		if err == nil && int64(len(body)) > rw.maxBody {
+			warnf("Not rewriting %s: body exceeds --max-buffered-body", resp.Request.URL.Path)
+		}
+		if err != nil || int64(len(body)) > rw.maxBody {
+			// Leave bodies we can't or won't decompress as they were
+			resp.Body = io.NopCloser(bytes.NewReader(raw))
+			return nil
+		}
+		resp.Header.Del("Content-Encoding")
+	}
+
+	rewritten := rw.replacer.Replace(string(body))
+	resp.Body = io.NopCloser(strings.NewReader(rewritten))
+	resp.ContentLength = int64(len(rewritten))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(rewritten)))
+
+	// The body no longer matches a strong validator
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RouteConfig maps a path prefix, or a regular expression matched against
+// the path, onto the backends that serve it. Backend uses the same
+// comma-separated host[:port] syntax as --proxy-for-host. StripPrefix, when
+// set, is removed from the path before forwarding and overrides
+// --strip-prefix. UpstreamTimeout and RetryAttempts, when set, override
+// --upstream-timeout and --retry-attempts for requests on the route.
+type RouteConfig struct {
+	Prefix          string        `yaml:"prefix"`
+	Pattern         string        `yaml:"pattern"`
+	Backend         string        `yaml:"backend"`
+	StripPrefix     string        `yaml:"stripPrefix"`
+	UpstreamTimeout time.Duration `yaml:"upstreamTimeout"`
+	RetryAttempts   *int          `yaml:"retryAttempts"`
+}
+
+// name identifies the route in errors and logs.
+func (rc RouteConfig) name() string {
+	if rc.Pattern != "" {
+		return rc.Pattern
+	}
+	return rc.Prefix
+}
+
+// route is a path prefix or pattern together with the backends that serve
+// it. The default route has neither. A zero upstreamTimeout and a nil
+// retryAttempts leave the global settings in effect.
+type route struct {
+	prefix          string
+	pattern         *regexp.Regexp
+	pool            *backendPool
+	stripPrefix     string
+	upstreamTimeout time.Duration
+	retryAttempts   *int
+}
+
+// routeContext is the request context key for the slot holding the route
+// the director picked, which the timeout and retry transports consult.
+type routeContext struct{}
+
+// routeSlot holds the route picked for a request.
+type routeSlot struct {
+	rt *route
+}
+
+// withRouteSlot gives every request to next an empty route slot, so the
+// director can record the route without replacing the request.
+func withRouteSlot(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), routeContext{}, &routeSlot{})))
+	})
+}
+
+// setRoute records rt as the route of req, if req has a slot for it.
+func setRoute(req *http.Request, rt *route) {
+	if slot, ok := req.Context().Value(routeContext{}).(*routeSlot); ok {
+		slot.rt = rt
+	}
+}
+
+// routeOf returns the route recorded for req, or nil if there is none.
+func routeOf(req *http.Request) *route {
+	if slot, ok := req.Context().Value(routeContext{}).(*routeSlot); ok {
+		return slot.rt
+	}
+	return nil
+}
+
+// name identifies the route in logs and on the status page.
+func (rt *route) name() string {
+	if rt.pattern != nil {
+		return rt.pattern.String()
+	}
+	return rt.prefix
+}
+
+// matches reports whether the route serves path.
+func (rt *route) matches(path string) bool {
+	if rt.pattern != nil {
+		return rt.pattern.MatchString(path)
+	}
+	return hasPathPrefix(path, rt.prefix)
+}
+
+// router picks the route for a request path: the first pattern route that
+// matches, in config order, then the longest matching prefix, falling back to
+// the default backends.
+type router struct {
+	routes   []*route
+	fallback *route
+}
+
+func newRouter(routes []RouteConfig, fallback *backendPool, defaultPort int, scheme, stripPrefix string) (*router, error) {
+	r := &router{fallback: &route{pool: fallback, stripPrefix: normalizePrefix(stripPrefix)}}
+	for _, rc := range routes {
+		pool, err := newBackendPool(rc.Backend, defaultPort, scheme)
+		if err != nil {
+			return nil, fmt.Errorf("route %s: %v", rc.name(), err)
+		}
+		strip := stripPrefix
+		if rc.StripPrefix != "" {
+			strip = rc.StripPrefix
+		}
+		rt := &route{
+			prefix:          rc.Prefix,
+			pool:            pool,
+			stripPrefix:     normalizePrefix(strip),
+			upstreamTimeout: rc.UpstreamTimeout,
+			retryAttempts:   rc.RetryAttempts,
+		}
+		if rc.Pattern != "" {
+			if rt.pattern, err = regexp.Compile(rc.Pattern); err != nil {
+				return nil, fmt.Errorf("route pattern %q: %v", rc.Pattern, err)
+			}
+		}
+		r.routes = append(r.routes, rt)
+	}
+
+	// Check patterns first in the order given, then longer prefixes first so
+	// the most specific prefix wins
+	sort.SliceStable(r.routes, func(i, j int) bool {
+		a, b := r.routes[i], r.routes[j]
+		if (a.pattern != nil) != (b.pattern != nil) {
+			return a.pattern != nil
+		}
+		return a.pattern == nil && len(a.prefix) > len(b.prefix)
+	})
+
+	return r, nil
+}
+
+// match returns the route for path.
+func (r *router) match(path string) *route {
+	for _, rt := range r.routes {
+		if rt.matches(path) {
+			return rt
+		}
+	}
+	return r.fallback
+}
+
+// rewritePath removes the route's strip prefix from the outgoing request
+// path. It runs after matching, and a path that becomes empty is sent as "/".
+func (rt *route) rewritePath(u *url.URL) {
+	if rt.stripPrefix == "" || !hasPathPrefix(u.Path, rt.stripPrefix) {
+		return
+	}
+
+	u.Path = ensureLeadingSlash(strings.TrimPrefix(u.Path, rt.stripPrefix))
+	if u.RawPath != "" {
+		if hasPathPrefix(u.RawPath, rt.stripPrefix) {
+			u.RawPath = ensureLeadingSlash(strings.TrimPrefix(u.RawPath, rt.stripPrefix))
+		} else {
+			// The prefix was escaped differently; fall back to the decoded path
+			u.RawPath = ""
+		}
+	}
+}
+
+func ensureLeadingSlash(path string) string {
+	if !strings.HasPrefix(path, "/") {
+		return "/" + path
+	}
+	return path
+}
+
+// normalizePrefix drops a trailing slash so "/api/" strips the same way as
+// "/api", turning "/api/" into "/" rather than "".
+func normalizePrefix(prefix string) string {
+	return strings.TrimSuffix(prefix, "/")
+}
+
+// hasPathPrefix reports whether path falls under prefix on a segment
+// boundary, so "/api" matches "/api" and "/api/users" but not "/apix".
+func hasPathPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+// validateRoutes checks the route table from the config file.
+func validateRoutes(routes []RouteConfig) error {
+	seen := map[string]bool{}
+	for _, rc := range routes {
+		switch {
+		case rc.Prefix != "" && rc.Pattern != "":
+			return fmt.Errorf("route %s cannot have both a prefix and a pattern", rc.Prefix)
+		case rc.Pattern != "":
+			if _, err := regexp.Compile(rc.Pattern); err != nil {
+				return fmt.Errorf("route pattern %q: %v", rc.Pattern, err)
+			}
+		case !strings.HasPrefix(rc.Prefix, "/"):
+			return fmt.Errorf("route prefix %q must start with /", rc.Prefix)
+		}
+		if strings.TrimSpace(rc.Backend) == "" {
+			return fmt.Errorf("route %s has no backend", rc.name())
+		}
+		if rc.StripPrefix != "" && !strings.HasPrefix(rc.StripPrefix, "/") {
+			return fmt.Errorf("route %s stripPrefix must start with /", rc.name())
+		}
+		if rc.UpstreamTimeout < 0 {
+			return fmt.Errorf("route %s upstreamTimeout cannot be negative", rc.name())
+		}
+		if rc.RetryAttempts != nil && *rc.RetryAttempts < 0 {
+			return fmt.Errorf("route %s retryAttempts cannot be negative", rc.name())
+		}
+		if seen[rc.name()] {
+			return fmt.Errorf("route %s is defined more than once", rc.name())
+		}
+		seen[rc.name()] = true
+	}
+	return nil
+}
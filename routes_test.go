@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestRewritePathStripPrefix(t *testing.T) {
+	tests := []struct {
+		strip, path, want string
+	}{
+		{"/api", "/api", "/"},
+		{"/api", "/api/", "/"},
+		{"/api", "/api/users", "/users"},
+		{"/api", "/api/users/", "/users/"},
+		{"/api", "/apix", "/apix"},
+		{"/api", "/other/api", "/other/api"},
+		{"/api", "/a%2Fb", "/a%2Fb"},
+		{"/api", "/api/a%2Fb", "/a%2Fb"},
+		{"/api/", "/api", "/"},
+		{"/api/", "/api/", "/"},
+		{"/api/", "/api/users", "/users"},
+		{"/", "/users", "/users"},
+	}
+	for _, tt := range tests {
+		router, err := newRouter(nil, &backendPool{}, 80, "http", tt.strip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, err := url.Parse("http://relay.test" + tt.path + "?q=1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		router.match(u.Path).rewritePath(u)
+		if got := u.EscapedPath(); got != tt.want {
+			t.Errorf("--strip-prefix %s: %s became %s, want %s", tt.strip, tt.path, got, tt.want)
+		}
+		if u.RawQuery != "q=1" {
+			t.Errorf("--strip-prefix %s: %s lost its query, got %q", tt.strip, tt.path, u.RawQuery)
+		}
+	}
+}
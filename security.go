@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// securityHeaders sets common security headers on responses. Headers the
+// backend already sent are kept unless override is set.
+type securityHeaders struct {
+	headers  [][2]string
+	override bool
+}
+
+func newSecurityHeaders(hstsMaxAge time.Duration, override bool) *securityHeaders {
+	return &securityHeaders{
+		headers: [][2]string{
+			{"Strict-Transport-Security", fmt.Sprintf("max-age=%d", int64(hstsMaxAge.Seconds()))},
+			{"X-Content-Type-Options", "nosniff"},
+			{"X-Frame-Options", "SAMEORIGIN"},
+			{"Referrer-Policy", "strict-origin-when-cross-origin"},
+		},
+		override: override,
+	}
+}
+
+func (s *securityHeaders) apply(h http.Header) {
+	for _, header := range s.headers {
+		if s.override || h.Get(header[0]) == "" {
+			h.Set(header[0], header[1])
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"strings"
+)
+
+// trailingSlashModes are the accepted --trailing-slash modes.
+var trailingSlashModes = map[string]bool{"add": true, "remove": true, "off": true}
+
+// trailingSlash redirects requests under prefixes, or all requests when
+// there are none, to the same path with a trailing slash ("add") or without
+// one ("remove"), so the backend only ever sees one variant. In "add" mode
+// paths whose last segment looks like a file name, such as /app.js, are left
+// alone. GET and HEAD get 301; other methods get 308 so clients repeat them
+// with the same method and body.
+func trailingSlash(mode string, prefixes []string, next http.Handler) http.Handler {
+	if mode == "off" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target, ok := slashTarget(mode, r.URL.Path)
+		if !ok || !underPrefixes(target, prefixes) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		status := http.StatusPermanentRedirect
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			status = http.StatusMovedPermanently
+		}
+		u := *r.URL
+		u.Path, u.RawPath = target, ""
+		http.Redirect(w, r, u.RequestURI(), status)
+	})
+}
+
+// slashTarget returns the path p should be redirected to, if any.
+func slashTarget(mode, p string) (string, bool) {
+	if p == "/" || !strings.HasPrefix(p, "/") {
+		return "", false
+	}
+	switch {
+	case mode == "add" && !strings.HasSuffix(p, "/") && !strings.Contains(path.Base(p), "."):
+		return p + "/", true
+	case mode == "remove" && strings.HasSuffix(p, "/"):
+		return strings.TrimRight(p, "/"), true
+	}
+	return "", false
+}
+
+// underPrefixes reports whether p falls under one of prefixes, which are
+// compared without a trailing slash so /docs covers both /docs and /docs/.
+func underPrefixes(p string, prefixes []string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	p = strings.TrimSuffix(p, "/")
+	for _, prefix := range prefixes {
+		if hasPathPrefix(p, normalizePrefix(prefix)) {
+			return true
+		}
+	}
+	return false
+}
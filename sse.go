@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"mime"
+	"net/http"
+	"time"
+)
+
+// responseControllerContext carries the client's ResponseController from
+// the proxy handler to ModifyResponse.
+type responseControllerContext struct{}
+
+// withResponseController records a ResponseController for each request so
+// ModifyResponse can adjust the client connection.
+func withResponseController(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), responseControllerContext{}, rc)))
+	})
+}
+
+// isEventStream reports whether resp is a server-sent event stream.
+func isEventStream(resp *http.Response) bool {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return mediaType == "text/event-stream"
+}
+
+// extendStream lifts the server's read and write deadlines for an event
+// stream or a gRPC call, which can stay open far longer than --read-timeout
+// and --write-timeout allow. The reverse proxy already flushes each event or
+// message as it arrives.
+func extendStream(resp *http.Response) {
+	rc, ok := resp.Request.Context().Value(responseControllerContext{}).(*http.ResponseController)
+	if !ok {
+		return
+	}
+	if err := rc.SetReadDeadline(time.Time{}); err != nil {
+		warnf("Cannot clear the read deadline for stream %s: %v", resp.Request.URL.Path, err)
+	}
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		warnf("Cannot clear the write deadline for stream %s: %v", resp.Request.URL.Path, err)
+	}
+}
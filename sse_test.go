@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readEvent reads one server-sent event, up to the blank line that ends it.
+func readEvent(r *bufio.Reader) (string, error) {
+	var event []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		line = strings.TrimRight(line, "\n")
+		if line == "" {
+			return strings.Join(event, "\n"), nil
+		}
+		event = append(event, line)
+	}
+}
+
+func TestProxyStreamsServerSentEvents(t *testing.T) {
+	// A long --flush-interval must not hold events back
+	for _, flushInterval := range []string{"0", "1h"} {
+		t.Run("flush-interval="+flushInterval, func(t *testing.T) {
+			release := make(chan struct{})
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/event-stream")
+				io.WriteString(w, "data: one\n\n")
+				w.(http.Flusher).Flush()
+				select {
+				case <-release:
+				case <-r.Context().Done():
+					return
+				}
+				// Outlast the relay's write timeout before the next event
+				time.Sleep(300 * time.Millisecond)
+				io.WriteString(w, "data: two\n\n")
+			}))
+			defer backend.Close()
+
+			config := testConfig(t, append(backendFlags(t, backend.URL), "--flush-interval", flushInterval)...)
+			transport, err := newTransport(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			relay := httptest.NewUnstartedServer(testProxy(t, config, transport))
+			relay.Config.WriteTimeout = 100 * time.Millisecond
+			relay.Start()
+			defer relay.Close()
+
+			client := &http.Client{Timeout: 5 * time.Second}
+			resp, err := client.Get(relay.URL + "/events")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body := bufio.NewReader(resp.Body)
+
+			// The backend is still waiting on release, so the first event
+			// can only arrive if the relay passed it on right away
+			if event, err := readEvent(body); err != nil || event != "data: one" {
+				t.Fatalf("first event = %q, %v; want \"data: one\"", event, err)
+			}
+			close(release)
+			if event, err := readEvent(body); err != nil || event != "data: two" {
+				t.Fatalf("second event = %q, %v; want \"data: two\" past the write timeout", event, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"html/template"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// connCounter counts open client connections. Its track method is an
+// http.Server ConnState hook.
+type connCounter struct {
+	open atomic.Int64
+}
+
+func (c *connCounter) track(_ net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		c.open.Add(1)
+	case http.StateHijacked, http.StateClosed:
+		c.open.Add(-1)
+	}
+}
+
+// statusPage serves a summary of the relay's runtime state, as HTML or as
+// JSON for clients that ask for it.
+type statusPage struct {
+	started time.Time
+	token   string
+	active  *activeRequests
+	conns   *connCounter
+	live    *atomic.Pointer[liveSettings]
+	checked bool
+	cache   *responseCache
+}
+
+// statusReport is the content of the status page.
+type statusReport struct {
+	Uptime          string          `json:"uptime"`
+	UptimeSeconds   int64           `json:"uptime_seconds"`
+	Requests        uint64          `json:"requests"`
+	ActiveRequests  int64           `json:"active_requests"`
+	OpenConnections int64           `json:"open_connections"`
+	Backends        []backendStatus `json:"backends"`
+	Cache           *cacheStatus    `json:"cache,omitempty"`
+}
+
+type backendStatus struct {
+	Route    string `json:"route"`
+	ID       string `json:"id"`
+	Address  string `json:"address"`
+	Weight   int    `json:"weight"`
+	Health   string `json:"health"`
+	Draining bool   `json:"draining"`
+}
+
+type cacheStatus struct {
+	Entries  int    `json:"entries"`
+	Bytes    int64  `json:"bytes"`
+	MaxBytes int64  `json:"max_bytes"`
+	Hits     uint64 `json:"hits"`
+	Misses   uint64 `json:"misses"`
+}
+
+var statusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head><title>jnb-relay status</title></head>
+<body>
+<h1>jnb-relay status</h1>
+<p>Up {{.Uptime}}, {{.Requests}} requests served, {{.ActiveRequests}} active, {{.OpenConnections}} open connections.</p>
+<h2>Backends</h2>
+<table>
+<tr><th>Route</th><th>ID</th><th>Address</th><th>Weight</th><th>Health</th><th>Draining</th></tr>
+{{range .Backends}}<tr><td>{{.Route}}</td><td>{{.ID}}</td><td>{{.Address}}</td><td>{{.Weight}}</td><td>{{.Health}}</td><td>{{if .Draining}}yes{{else}}no{{end}}</td></tr>
+{{end}}</table>
+{{with .Cache}}<h2>Cache</h2>
+<p>{{.Entries}} entries, {{.Bytes}} of {{.MaxBytes}} bytes, {{.Hits}} hits, {{.Misses}} misses.</p>
+{{end}}</body>
+</html>
+`))
+
+func (p *statusPage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if p.token != "" && !validBearerToken(r, p.token) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="jnb-relay"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	report := p.report()
+	w.Header().Set("Cache-Control", "no-store")
+	if wantsJSON(r) || r.URL.Query().Get("format") == "json" {
+		writeJSON(w, http.StatusOK, report)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	statusTemplate.Execute(w, report)
+}
+
+func (p *statusPage) report() *statusReport {
+	uptime := time.Since(p.started)
+	report := &statusReport{
+		Uptime:          uptime.Round(time.Second).String(),
+		UptimeSeconds:   int64(uptime.Seconds()),
+		Requests:        p.active.total.Load(),
+		ActiveRequests:  p.active.count.Load(),
+		OpenConnections: p.conns.open.Load(),
+	}
+
+	settings := p.live.Load()
+	report.Backends = p.backends("", settings.pool)
+	if settings.canary != nil {
+		report.Backends = append(report.Backends, p.backends("canary", settings.canary)...)
+	}
+	for _, rt := range settings.routes.routes {
+		report.Backends = append(report.Backends, p.backends(rt.name(), rt.pool)...)
+	}
+
+	if p.cache != nil {
+		report.Cache = p.cache.status()
+	}
+	return report
+}
+
+func (p *statusPage) backends(route string, pool *backendPool) []backendStatus {
+	if route == "" {
+		route = "default"
+	}
+	statuses := make([]backendStatus, len(pool.backends))
+	for i, b := range pool.backends {
+		health := "unchecked"
+		if p.checked {
+			health = "up"
+			if b.down.Load() {
+				health = "down"
+			}
+		}
+		statuses[i] = backendStatus{Route: route, ID: b.id(), Address: b.String(), Weight: b.weight, Health: health, Draining: b.draining.Load()}
+	}
+	return statuses
+}
+
+// validBearerToken reports whether r carries token as a bearer token. The
+// comparison takes constant time.
+func validBearerToken(r *http.Request, token string) bool {
+	const prefix = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if len(auth) < len(prefix) || auth[:len(prefix)] != prefix {
+		return false
+	}
+	got := sha256.Sum256([]byte(auth[len(prefix):]))
+	want := sha256.Sum256([]byte(token))
+	return subtle.ConstantTimeCompare(got[:], want[:]) == 1
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// statusRemap replaces backend response statuses, e.g. 520 with 502, before
+// anything else looks at the response.
+type statusRemap map[int]int
+
+// newStatusRemap parses "from=to" rules. A status may only be mapped once.
+func newStatusRemap(rules []string) (statusRemap, error) {
+	remap := statusRemap{}
+	for _, rule := range rules {
+		from, to, ok := strings.Cut(rule, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid status rule %q, expected \"from=to\"", rule)
+		}
+		fromCode, err := strconv.Atoi(strings.TrimSpace(from))
+		if err != nil || fromCode < 200 || fromCode > 999 {
+			return nil, fmt.Errorf("invalid status rule %q: %q is not a status between 200 and 999", rule, from)
+		}
+		toCode, err := strconv.Atoi(strings.TrimSpace(to))
+		if err != nil || toCode < 200 || toCode > 599 {
+			return nil, fmt.Errorf("invalid status rule %q: %q is not a status between 200 and 599", rule, to)
+		}
+		if _, dup := remap[fromCode]; dup {
+			return nil, fmt.Errorf("status %d is remapped more than once", fromCode)
+		}
+		remap[fromCode] = toCode
+	}
+	return remap, nil
+}
+
+// apply rewrites the response status if a rule matches it.
+func (remap statusRemap) apply(resp *http.Response) {
+	to, ok := remap[resp.StatusCode]
+	if !ok {
+		return
+	}
+	resp.StatusCode = to
+	resp.Status = fmt.Sprintf("%d %s", to, http.StatusText(to))
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"time"
+)
+
+// stickySessions pins clients to a backend with a cookie naming it. The
+// cookie holds a hash of the backend address, so it is stable across
+// restarts without revealing the address.
+type stickySessions struct {
+	cookie string
+	ttl    time.Duration
+	path   string
+}
+
+func newStickySessions(cookie string, ttl time.Duration, mount mountPath) *stickySessions {
+	path := "/"
+	if mount != "" {
+		path = string(mount)
+	}
+	return &stickySessions{cookie: cookie, ttl: ttl, path: path}
+}
+
+// backendID returns the cookie value for the backend at host.
+func backendID(host string) string {
+	sum := sha256.Sum256([]byte(host))
+	return hex.EncodeToString(sum[:8])
+}
+
+// pick returns the backend named by the request's cookie if it is in pool
+// and available, and the next one in rotation otherwise.
+func (s *stickySessions) pick(req *http.Request, pool *backendPool) *backend {
+	if c, err := req.Cookie(s.cookie); err == nil {
+		for _, b := range pool.backends {
+			if backendID(b.id()) == c.Value && b.available() {
+				return b
+			}
+		}
+	}
+	return pool.pick()
+}
+
+// setCookie points the client's cookie at the backend that served resp,
+// unless it already does.
+func (s *stickySessions) setCookie(resp *http.Response) {
+	id := backendID(resp.Request.URL.Host)
+	if c, err := resp.Request.Cookie(s.cookie); err == nil && c.Value == id {
+		return
+	}
+
+	cookie := &http.Cookie{
+		Name:     s.cookie,
+		Value:    id,
+		Path:     s.path,
+		HttpOnly: true,
+		Secure:   publicOriginOf(resp.Request).scheme == "https",
+		SameSite: http.SameSiteLaxMode,
+	}
+	if s.ttl > 0 {
+		cookie.MaxAge = int(s.ttl.Seconds())
+	}
+	resp.Header.Add("Set-Cookie", cookie.String())
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// listenFDsStart is the first file descriptor systemd passes to a
+// socket-activated service.
+const listenFDsStart = 3
+
+// activatedListeners returns the listening sockets systemd passed in through
+// socket activation, or none when the relay was started without any.
+// LISTEN_PID guards against picking up variables meant for a parent process,
+// and the variables are cleared so child processes don't inherit them.
+func activatedListeners() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("socket activation: invalid LISTEN_FDS %q", os.Getenv("LISTEN_FDS"))
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	var listeners []net.Listener
+	for fd := listenFDsStart; fd < listenFDsStart+n; fd++ {
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		listener, err := net.FileListener(f)
+		// FileListener dups the descriptor, so the original can go
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("socket activation: fd %d: %v", fd, err)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+)
+
+// newTimeoutTransport bounds each upstream attempt, from sending the request
+// until the response body is closed, to timeout, or to the upstream timeout
+// of the request's route if it has one. A zero timeout leaves attempts
+// unbounded. Protocol upgrades such as WebSockets are exempt, since the
+// connection outlives the request.
+func newTimeoutTransport(next http.RoundTripper, timeout time.Duration) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		timeout := timeout
+		if rt := routeOf(req); rt != nil && rt.upstreamTimeout > 0 {
+			timeout = rt.upstreamTimeout
+		}
+		if timeout <= 0 || req.Header.Get("Upgrade") != "" {
+			return next.RoundTrip(req)
+		}
+
+		ctx, cancel := context.WithTimeout(req.Context(), timeout)
+		resp, err := next.RoundTrip(req.WithContext(ctx))
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+		return resp, nil
+	})
+}
+
+// cancelOnClose releases a request context once its body is done with.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// tlsVersions maps the accepted --min-tls-version values to their constants.
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// newTLSConfig builds the server TLS configuration from the minimum version
+// and cipher suite settings, serving certificates from getCertificate.
+func newTLSConfig(config *Config, getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) (*tls.Config, error) {
+	cipherSuites, err := parseCipherSuites(config.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		GetCertificate: getCertificate,
+		MinVersion:     tlsVersions[config.MinTLSVersion],
+		CipherSuites:   cipherSuites,
+	}
+
+	// Require client certificates signed by the given CA
+	if config.ClientCAFile != "" {
+		pool, err := loadCertPool(config.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+// loadCertPool reads a PEM bundle of CA certificates.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read CA bundle: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// setClientCertHeader forwards the common name of the verified client
+// certificate to the backend. Any value sent by the client is replaced so it
+// cannot be spoofed.
+func setClientCertHeader(req *http.Request) {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+		req.Header.Del("X-Client-Cert-CN")
+		return
+	}
+	req.Header.Set("X-Client-Cert-CN", req.TLS.VerifiedChains[0][0].Subject.CommonName)
+}
+
+// parseCipherSuites resolves cipher suite names to their IDs. Only suites
+// Go considers secure are accepted. An empty list keeps Go's defaults.
+func parseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	known := map[string]uint16{}
+	for _, suite := range configurableCipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+
+	var ids []uint16
+	for _, name := range names {
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q, supported suites are: %s", name, strings.Join(secureCipherSuiteNames(), ", "))
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func secureCipherSuiteNames() []string {
+	var names []string
+	for _, suite := range configurableCipherSuites() {
+		names = append(names, suite.Name)
+	}
+	return names
+}
+
+// configurableCipherSuites returns the secure suites usable below TLS 1.3.
+// TLS 1.3 suites are always enabled by Go and cannot be selected.
+func configurableCipherSuites() []*tls.CipherSuite {
+	var suites []*tls.CipherSuite
+	for _, suite := range tls.CipherSuites() {
+		for _, version := range suite.SupportedVersions {
+			if version < tls.VersionTLS13 {
+				suites = append(suites, suite)
+				break
+			}
+		}
+	}
+	return suites
+}
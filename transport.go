@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// newTransport returns the RoundTripper used to reach the backends.
+func newTransport(config *Config) (http.RoundTripper, error) {
+	dial := dialBackend(config.ProxySocket, net.ParseIP(config.BackendLocalAddr), config.UpstreamTCPKeepAlive, config.DNSCacheTTL)
+
+	if config.BackendHTTP2 {
+		// The backends are plain HTTP, so speak HTTP/2 with prior knowledge
+		// (h2c) over an unencrypted connection. Requests share one
+		// multiplexed connection per backend, so only the idle timeout
+		// applies.
+		return &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dial(ctx, network, addr)
+			},
+			IdleConnTimeout: config.UpstreamIdleConnTimeout,
+		}, nil
+	}
+
+	if config.PreserveHeaderCase {
+		dialPlain := dial
+		dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialPlain(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return &headerCaseConn{Conn: conn}, nil
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dial
+	transport.MaxIdleConns = config.UpstreamMaxIdleConns
+	transport.MaxIdleConnsPerHost = config.UpstreamMaxIdleConnsPerHost
+	transport.IdleConnTimeout = config.UpstreamIdleConnTimeout
+	transport.DisableKeepAlives = config.UpstreamDisableKeepAlives
+	if config.BackendTLS {
+		tlsConfig, err := newBackendTLSConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	if config.PreserveHeaderCase {
+		return &headerCaseTransport{next: transport}, nil
+	}
+	return transport, nil
+}
+
+// insecureBackendWarning logs --backend-insecure-skip-verify once, although
+// the proxy, the mirror and the health checks each build a transport.
+var insecureBackendWarning sync.Once
+
+// newBackendTLSConfig builds the client TLS configuration for HTTPS
+// backends, verifying them against --backend-ca when set and the system
+// roots otherwise. Without --backend-server-name, each backend's certificate
+// must match the host it is addressed by.
+func newBackendTLSConfig(config *Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         config.BackendServerName,
+		InsecureSkipVerify: config.BackendInsecureSkipVerify,
+	}
+	if config.BackendInsecureSkipVerify {
+		insecureBackendWarning.Do(func() {
+			warnf("Backend certificates are not verified (--backend-insecure-skip-verify)")
+		})
+	}
+	if config.BackendCAFile != "" {
+		pool, err := loadCertPool(config.BackendCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("--backend-ca: %v", err)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+// dialBackend returns a dial function that connects to socket, if set, for
+// the socket backend and over TCP for everything else. TCP connections send
+// keep-alive probes every keepAlive, or none when it is 0. With a
+// dnsCacheTTL, host names are resolved through a dnsCache.
+func dialBackend(socket string, localIP net.IP, keepAlive, dnsCacheTTL time.Duration) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if keepAlive == 0 {
+		// net.Dialer treats 0 as its default and a negative value as off
+		keepAlive = -1
+	}
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: keepAlive}
+	socketDialer := *dialer
+	if localIP != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: localIP}
+	}
+	socketAddr := net.JoinHostPort(socketBackendHost, "80")
+	dialTCP := dialer.DialContext
+	if dnsCacheTTL > 0 {
+		dialTCP = newDNSCache(dnsCacheTTL).dialContext(dialer.DialContext)
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if socket != "" && addr == socketAddr {
+			return socketDialer.DialContext(ctx, "unix", socket)
+		}
+		return dialTCP(ctx, network, addr)
+	}
+}
+
+// dialFrom connects to a backend like net.DialTimeout, from localIP if it is
+// set and the backend is reached over TCP.
+func dialFrom(localIP net.IP, network, addr string, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	if localIP != nil && network != "unix" {
+		dialer.LocalAddr = &net.TCPAddr{IP: localIP}
+	}
+	return dialer.Dial(network, addr)
+}
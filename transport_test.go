@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// tlsRelay starts the relay for config over TLS with HTTP/2 enabled, so
+// clients can negotiate h2 as browsers do.
+func tlsRelay(t *testing.T, config *Config) *httptest.Server {
+	t.Helper()
+	transport, err := newTransport(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay := httptest.NewUnstartedServer(testProxy(t, config, transport))
+	relay.EnableHTTP2 = true
+	relay.StartTLS()
+	return relay
+}
+
+func TestBackendHTTP2(t *testing.T) {
+	// The backend accepts both h2c and HTTP/1.1 and reports which it got
+	backend := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, strconv.Itoa(r.ProtoMajor))
+	}), &http2.Server{}))
+	defer backend.Close()
+
+	for _, tt := range []struct {
+		args        []string
+		wantBackend string
+	}{
+		{[]string{"--backend-http2"}, "2"},
+		{nil, "1"},
+	} {
+		relay := tlsRelay(t, testConfig(t, append(backendFlags(t, backend.URL), tt.args...)...))
+		resp, err := relay.Client().Get(relay.URL + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		relay.Close()
+
+		if resp.ProtoMajor != 2 {
+			t.Errorf("%q: client leg spoke HTTP/%d, want HTTP/2", tt.args, resp.ProtoMajor)
+		}
+		if string(body) != tt.wantBackend {
+			t.Errorf("%q: backend leg spoke HTTP/%s, want HTTP/%s", tt.args, body, tt.wantBackend)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// tunnelDialTimeout bounds connecting a CONNECT tunnel to its backend.
+const tunnelDialTimeout = 10 * time.Second
+
+// tunnelConnect answers CONNECT requests by connecting to the next default
+// backend and piping bytes both ways until either side closes, for relays
+// that front a plain TCP service. The authority the client asks for is
+// ignored, so the relay cannot be used as an open proxy. Other requests go
+// to next.
+func tunnelConnect(live *atomic.Pointer[liveSettings], localIP net.IP, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// HTTP/2 and HTTP/3 connections carry other streams and cannot be
+		// handed over
+		if r.ProtoMajor != 1 {
+			http.Error(w, "CONNECT is only supported over HTTP/1.1", http.StatusHTTPVersionNotSupported)
+			return
+		}
+
+		network, addr := live.Load().pool.pick().address()
+		upstream, err := dialFrom(localIP, network, addr, tunnelDialTimeout)
+		if err != nil {
+			errorf("Tunnel to %s failed: %v", addr, err)
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			return
+		}
+		defer upstream.Close()
+
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			errorf("Tunnel to %s failed: %v", addr, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		defer conn.Close()
+		if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+			return
+		}
+
+		// Bytes the client sent right after the request may already sit in
+		// the server's read buffer, so copy from that rather than conn
+		done := make(chan struct{}, 2)
+		go func() {
+			io.Copy(upstream, brw)
+			done <- struct{}{}
+		}()
+		go func() {
+			io.Copy(conn, upstream)
+			done <- struct{}{}
+		}()
+		<-done
+	})
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+)
+
+// version, commit and buildDate describe the build. Release builds set them
+// with -ldflags "-X main.version=v1.2.0 -X main.commit=... -X main.buildDate=...";
+// otherwise commit and buildDate fall back to the VCS details Go embeds when
+// building from a checkout.
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// buildInfo is the build description printed by --version and served on
+// --version-path.
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"buildDate"`
+}
+
+func currentBuild() buildInfo {
+	info := buildInfo{Version: version, Commit: commit, BuildDate: buildDate}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			switch {
+			case s.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = s.Value
+			case s.Key == "vcs.time" && info.BuildDate == "":
+				info.BuildDate = s.Value
+			}
+		}
+	}
+	return info
+}
+
+func (b buildInfo) String() string {
+	s := "jnb-relay " + b.Version
+	if b.Commit != "" {
+		s += fmt.Sprintf(" (commit %s, built %s)", b.Commit, b.BuildDate)
+	}
+	return s
+}
+
+// versionHandler reports the build the relay is running, to confirm a
+// deployment rolled out.
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, currentBuild())
+}